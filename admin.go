@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ancientlore/flagcfg"
+)
+
+// handleAdmin registers the admin endpoints on the status web site
+func handleAdmin(folders *folderManager) {
+	http.HandleFunc("/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, adminResult{Error: "use POST"})
+			return
+		}
+		err := folders.Reload(flagcfg.Filename(), drainTimeout)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, adminResult{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, adminResult{OK: true})
+	})
+
+	http.HandleFunc("/admin/folders", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, adminResult{Error: "use GET"})
+			return
+		}
+		cfg := folders.Folders()
+		list := make([]folderStatus, 0, len(cfg))
+		for _, name := range sortedNames(cfg) {
+			list = append(list, newFolderStatus(name, cfg[name]))
+		}
+		writeJSON(w, http.StatusOK, list)
+	})
+
+	// /admin/folders/{name} and /admin/folders/{name}/{action}
+	http.HandleFunc("/admin/folders/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/folders/"), "/")
+		if len(parts) > 2 {
+			writeJSON(w, http.StatusNotFound, adminResult{Error: "not found"})
+			return
+		}
+		name := parts[0]
+		cfg, ok := folders.Folder(name)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, adminResult{Error: "folder not running: " + name})
+			return
+		}
+		if len(parts) == 1 {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				writeJSON(w, http.StatusMethodNotAllowed, adminResult{Error: "use GET"})
+				return
+			}
+			writeJSON(w, http.StatusOK, newFolderStatus(name, cfg))
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, adminResult{Error: "use POST"})
+			return
+		}
+		switch parts[1] {
+		case "pause":
+			log.Print(name, ": paused through the admin API")
+			cfg.control.Pause()
+		case "resume":
+			log.Print(name, ": resumed through the admin API")
+			cfg.control.Resume()
+		case "rescan":
+			cfg.control.Rescan()
+		case "requeue":
+			moved, err := requeueFiles(name, cfg, r.FormValue("match"))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, adminResult{Error: err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, requeueResult{OK: true, Files: moved})
+			return
+		default:
+			writeJSON(w, http.StatusNotFound, adminResult{Error: "unknown action: " + parts[1]})
+			return
+		}
+		writeJSON(w, http.StatusOK, adminResult{OK: true})
+	})
+}
+
+// adminResult is the response of an admin action
+type adminResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// requeueResult is the response of a requeue request
+type requeueResult struct {
+	OK    bool     `json:"ok"`
+	Files []string `json:"files"` // files moved back into the folder
+}
+
+// folderStatus describes a running folder
+type folderStatus struct {
+	Name     string                 `json:"name"`
+	Paused   bool                   `json:"paused"`
+	Breaker  string                 `json:"breaker"`  // circuit breaker state
+	InFlight int                    `json:"inFlight"` // files being posted
+	Retrying int                    `json:"retrying"` // failed files waiting for a retry
+	Posted   int64                  `json:"posted"`
+	Failed   int64                  `json:"failed"`
+	Sent     int64                  `json:"sent"`     // bytes sent
+	Received int64                  `json:"received"` // bytes received
+	Config   map[string]interface{} `json:"config"`   // effective settings, named as in the config file
+}
+
+// newFolderStatus gathers the status of a running folder
+func newFolderStatus(name string, cfg *FolderCfg) folderStatus {
+	st := folderStatus{
+		Name:     name,
+		Paused:   cfg.control.Paused(),
+		Breaker:  cfg.breaker.State(),
+		InFlight: cfg.inflight.Len(),
+		Retrying: cfg.retries.Len(),
+		Posted:   cfg.stats.Posted.Load(),
+		Failed:   cfg.stats.Failed.Load(),
+		Sent:     cfg.stats.Sent.Load(),
+		Received: cfg.stats.Received.Load(),
+	}
+	// going through TOML keeps the names and formats of the config file
+	if _, err := toml.Decode(cfg.String(), &st.Config); err != nil {
+		log.Print(name, ": Unable to decode configuration: ", err)
+	}
+	return st
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
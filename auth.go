@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auth modes
+const (
+	AuthBasic  = "basic"  // HTTP Basic authentication with username and password
+	AuthBearer = "bearer" // a bearer token read from tokenfile
+	AuthOAuth2 = "oauth2" // a bearer token from the OAuth2 client credentials grant
+)
+
+// secretMask replaces secrets when a config is printed
+const secretMask = "xxxxx"
+
+// maxTokenResponse is the largest token endpoint response that is read
+const maxTokenResponse = 64 * 1024
+
+// authenticator provides the credentials of requests
+type authenticator interface {
+	// Authorization returns the value of the Authorization header
+	Authorization(ctx context.Context, client *http.Client) (string, error)
+	// Refresh drops the credentials after the server rejected them, returning
+	// whether new ones might be accepted
+	Refresh() bool
+}
+
+// ParseAuth checks the auth settings of a folder and sets up its authenticator
+func (c *FolderCfg) ParseAuth() error {
+	c.auth = nil
+	switch c.Auth {
+	case "":
+	case AuthBasic:
+		if c.Username == "" {
+			return errors.New("auth basic needs a username")
+		}
+		c.auth = basicAuth("Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password)))
+	case AuthBearer:
+		if c.TokenFile == "" {
+			return errors.New("auth bearer needs a tokenfile")
+		}
+		t := &tokenFile{fn: c.TokenFile}
+		if _, err := t.Authorization(context.Background(), nil); err != nil {
+			return err
+		}
+		c.auth = t
+	case AuthOAuth2:
+		if c.TokenURL == "" || c.ClientID == "" {
+			return errors.New("auth oauth2 needs a tokenurl and clientid")
+		}
+		if _, err := url.ParseRequestURI(c.TokenURL); err != nil {
+			return fmt.Errorf("tokenurl: %w", err)
+		}
+		c.auth = &clientCredentials{tokenURL: c.TokenURL, clientID: c.ClientID, clientSecret: c.ClientSecret, scopes: c.Scopes}
+	default:
+		return fmt.Errorf("unknown auth %q", c.Auth)
+	}
+	return nil
+}
+
+// redact hides the secrets of a config that is about to be printed
+func (c *DefaultCfg) redact() {
+	if c.Password != "" {
+		c.Password = secretMask
+	}
+	if c.ClientSecret != "" {
+		c.ClientSecret = secretMask
+	}
+	if u, err := url.Parse(c.Proxy); err == nil && u.User != nil {
+		c.Proxy = u.Redacted()
+	}
+}
+
+// setAuth sets the Authorization header of a request
+func setAuth(req *http.Request, cfg *FolderCfg) error {
+	if cfg.auth == nil {
+		return nil
+	}
+	v, err := cfg.auth.Authorization(req.Context(), cfg.client)
+	if err != nil {
+		if req.Context().Err() != nil {
+			return req.Context().Err()
+		}
+		// credentials are a problem of the endpoint, not the file
+		return postError{err: err, action: OutcomeRetry, url: req.URL.String()}
+	}
+	req.Header.Set("Authorization", v)
+	return nil
+}
+
+// withReauth sends again once with fresh credentials if the server rejects
+// the credentials with 401
+func withReauth(name string, cfg *FolderCfg, send func(url string) error) func(url string) error {
+	if cfg.auth == nil {
+		return send
+	}
+	return func(url string) error {
+		err := send(url)
+		if pe, ok := err.(postError); ok && pe.status == http.StatusUnauthorized && cfg.auth.Refresh() {
+			log.Print(name, ": credentials rejected by ", url, ", retrying with new credentials")
+			err = send(url)
+		}
+		return err
+	}
+}
+
+// basicAuth is the header value of HTTP Basic authentication
+type basicAuth string
+
+func (b basicAuth) Authorization(context.Context, *http.Client) (string, error) {
+	return string(b), nil
+}
+
+// Refresh returns false since the password does not change
+func (b basicAuth) Refresh() bool {
+	return false
+}
+
+// tokenFile is a bearer token that is read again when its file changes
+type tokenFile struct {
+	fn string
+
+	mu    sync.Mutex
+	token string
+	mod   time.Time // modification time of the file when the token was read
+}
+
+func (t *tokenFile) Authorization(context.Context, *http.Client) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	mod, err := modTime(t.fn)
+	if err != nil {
+		return "", err
+	}
+	if t.token == "" || !mod.Equal(t.mod) {
+		data, err := ioutil.ReadFile(t.fn)
+		if err != nil {
+			return "", err
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("tokenfile %s is empty", t.fn)
+		}
+		t.token, t.mod = token, mod
+	}
+	return "Bearer " + t.token, nil
+}
+
+// Refresh returns whether the token file changed since the token was read
+func (t *tokenFile) Refresh() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	mod, err := modTime(t.fn)
+	return err == nil && !mod.Equal(t.mod)
+}
+
+// clientCredentials is a bearer token from an OAuth2 token endpoint, cached
+// until shortly before it expires
+type clientCredentials struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time // when the token needs refreshing, zero if it does not expire
+}
+
+// tokenResponse is the answer of a token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (c *clientCredentials) Authorization(ctx context.Context, client *http.Client) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" || (!c.expiry.IsZero() && time.Now().After(c.expiry)) {
+		if err := c.fetch(ctx, client); err != nil {
+			return "", err
+		}
+	}
+	return "Bearer " + c.token, nil
+}
+
+// fetch gets a new token from the token endpoint; the lock must be held
+func (c *clientCredentials) fetch(ctx context.Context, client *http.Client) error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if c.scopes != "" {
+		form.Set("scope", strings.Join(strings.FieldsFunc(c.scopes, func(r rune) bool { return r == ',' || r == ' ' }), " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTokenResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request to %s failed, status %s: %s", c.tokenURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tr tokenResponse
+	if err = json.Unmarshal(body, &tr); err != nil {
+		return fmt.Errorf("token response from %s: %w", c.tokenURL, err)
+	}
+	if tr.AccessToken == "" {
+		return fmt.Errorf("no access token from %s", c.tokenURL)
+	}
+	c.token = tr.AccessToken
+	c.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		// refresh a little early so that the token does not expire in flight
+		c.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second * 9 / 10)
+	}
+	return nil
+}
+
+// Refresh drops the cached token so that the next request gets a new one
+func (c *clientCredentials) Refresh() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+	return true
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ancientlore/kubismus"
+)
+
+// batch formats
+const (
+	BatchNDJSON    = "ndjson"    // one JSON object per line
+	BatchJSON      = "json"      // a JSON array of objects
+	BatchMultipart = "multipart" // a multipart/mixed body with one part per file
+	BatchTar       = "tar"       // a tar stream
+)
+
+// batchFile is a file claimed for a batch
+type batchFile struct {
+	inf   os.FileInfo
+	fname string       // path of the file, which may be its claimed name
+	rec   *auditRecord // journal record of the file
+}
+
+// batchEntry is how a file is encoded in the JSON formats
+type batchEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Content *string   `json:"content,omitempty"` // contents of a UTF-8 text file
+	Base64  []byte    `json:"base64,omitempty"`  // contents of any other file
+}
+
+// batchThread posts the files from the channel in batches until it is closed
+// or ctx is done. A batch is sent once it holds batchfiles files or
+// batchbytes bytes, or no more files arrive within batchwait.
+func batchThread(ctx, postCtx context.Context, name string, cfg *FolderCfg, ch <-chan os.FileInfo, wg *sync.WaitGroup) {
+	done := ctx.Done()
+	defer wg.Done()
+
+	// a file that did not fit in the previous batch starts the next one
+	var carry os.FileInfo
+	for {
+		var batch []os.FileInfo
+		var size int64
+		if carry != nil {
+			batch, size, carry = append(batch, carry), carry.Size(), nil
+		} else {
+			select {
+			case inf, ok := <-ch:
+				if !ok {
+					return
+				}
+				batch, size = append(batch, inf), inf.Size()
+			case <-done:
+				return
+			}
+		}
+
+		closed := false
+		timer := time.NewTimer(time.Duration(cfg.BatchWait))
+	collect:
+		for len(batch) < cfg.BatchFiles && (cfg.BatchBytes <= 0 || size < cfg.BatchBytes) {
+			select {
+			case inf, ok := <-ch:
+				if !ok {
+					closed = true
+					break collect
+				}
+				if cfg.BatchBytes > 0 && size+inf.Size() > cfg.BatchBytes {
+					carry = inf
+					break collect
+				}
+				batch, size = append(batch, inf), size+inf.Size()
+			case <-timer.C:
+				break collect
+			case <-done:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		// files that were not posted yet are left for the next run
+		if ctx.Err() != nil {
+			for _, inf := range batch {
+				cfg.inflight.Release(inf.Name())
+			}
+			if carry != nil {
+				cfg.inflight.Release(carry.Name())
+			}
+			return
+		}
+
+		processBatch(postCtx, name, cfg, batch)
+		for _, inf := range batch {
+			cfg.inflight.Release(inf.Name())
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// processBatch posts a batch of files in one request, then deletes or moves
+// all of them or records the failure for all of them
+func processBatch(ctx context.Context, name string, cfg *FolderCfg, batch []os.FileInfo) {
+	var files []batchFile
+	for _, inf := range batch {
+		// large files are uploaded in chunks on their own
+		if chunked(cfg, inf) {
+			processFile(ctx, name, cfg, inf)
+			continue
+		}
+		fname, release, ok := claimFile(name, cfg, inf)
+		if !ok {
+			continue
+		}
+		defer release()
+		if quarantineOversized(name, cfg, fname, inf) {
+			continue
+		}
+		rec := newAuditRecord(name, cfg, inf)
+		rec.Attempt = cfg.retries.Attempts(inf.Name()) + 1
+		files = append(files, batchFile{inf: inf, fname: fname, rec: rec})
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	err := postBatch(ctx, name, cfg, files)
+	for _, f := range files {
+		finishFile(ctx, name, cfg, f.fname, f.inf, err, f.rec)
+		cfg.journal.Write(f.rec)
+	}
+}
+
+// postBatch posts a batch of files to the folder's URLs, using the templates
+// as filled in for the first file
+func postBatch(ctx context.Context, name string, cfg *FolderCfg, files []batchFile) error {
+	// the batch as a whole is recorded, then copied to the record of each file
+	rec := new(auditRecord)
+	defer func() {
+		for _, f := range files {
+			f.rec.URL, f.rec.Method, f.rec.RequestID = rec.URL, rec.Method, rec.RequestID
+			f.rec.Status, f.rec.Latency, f.rec.Delivered = rec.Status, rec.Latency, rec.Delivered
+		}
+	}()
+
+	data := newFileData(cfg, files[0].inf)
+	urls, err := expandTargets(cfg, data)
+	if err != nil {
+		log.Print(name, ": Unable to prepare batch: ", err)
+		return postError{err: err, action: OutcomeFail}
+	}
+	spec := &requestSpec{method: cfg.Method}
+	spec.headers, err = expandHeaders("header", cfg.Headers, data)
+	if err != nil {
+		log.Print(name, ": Unable to prepare batch: ", err)
+		return postError{err: err, action: OutcomeFail}
+	}
+
+	// only URLs that have every file in the batch are skipped
+	var has map[string]bool
+	for i, f := range files {
+		fhas := make(map[string]bool)
+		for _, t := range cfg.retries.Delivered(f.inf.Name()) {
+			if i == 0 || has[t] {
+				fhas[t] = true
+			}
+		}
+		has = fhas
+	}
+
+	return postTargets(ctx, name, cfg, urls, has, func(url string) error {
+		return postBatchTarget(ctx, name, cfg, url, spec, files, rec)
+	}, rec)
+}
+
+// postBatchTarget posts a batch of files to one URL, streaming the encoded files
+func postBatchTarget(ctx context.Context, name string, cfg *FolderCfg, url string, spec *requestSpec, files []batchFile, rec *auditRecord) error {
+	pr, pw := io.Pipe()
+	cw := &countWriter{w: pw}
+	var mw *multipart.Writer
+	var ct string
+	switch cfg.BatchFormat {
+	case BatchJSON:
+		ct = "application/json"
+	case BatchMultipart:
+		mw = multipart.NewWriter(cw)
+		ct = "multipart/mixed; boundary=" + mw.Boundary()
+	case BatchTar:
+		ct = "application/x-tar"
+	default:
+		ct = "application/x-ndjson"
+	}
+
+	// hash each file for the journal
+	hashes := make([]string, len(files))
+	encoded := make(chan error, 1)
+	go func() {
+		err := encodeBatch(cw, mw, cfg.BatchFormat, files, cfg.journal != nil, hashes)
+		pw.CloseWithError(err)
+		encoded <- err
+	}()
+
+	// compress the batch if desired
+	var body io.Reader = pr
+	var stop func() int64
+	if cfg.Encode != "" {
+		body, stop = compressBody(pr, cfg.Encode)
+	}
+
+	rec.URL = url
+	rec.Method = spec.method
+	req, err := http.NewRequestWithContext(ctx, spec.method, url, body)
+	if err != nil {
+		if stop != nil {
+			stop()
+		}
+		pr.Close()
+		<-encoded
+		return postError{err: err, action: OutcomeFail, url: url}
+	}
+	req.Header.Set("Content-Type", ct)
+	if stop != nil {
+		req.Header.Set("Content-Encoding", cfg.Encode)
+	}
+	if cfg.FileInfo {
+		req.Header.Set("X-Autohurl-Count", fmt.Sprint(len(files)))
+	}
+	if err = setHeaders(req, cfg, spec, rec); err != nil {
+		if stop != nil {
+			stop()
+		}
+		pr.Close()
+		<-encoded
+		return err
+	}
+
+	t := time.Now()
+	resp, err := cfg.client.Do(req)
+	var n int64
+	if stop != nil {
+		n = stop()
+	}
+	pr.Close()
+	encErr := <-encoded
+	for i, f := range files {
+		f.rec.SHA256 = hashes[i]
+	}
+	rec.Latency = time.Since(t).Seconds()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if encErr != nil && encErr != io.ErrClosedPipe {
+		// a file could not be read, so the request was cut short
+		if err == nil {
+			resp.Body.Close()
+		}
+		log.Print(name, ": Unable to read batch: ", encErr)
+		return encErr
+	}
+	if err != nil {
+		kubismus.Metric(name+"_Errors", 1, 0)
+		log.Print(name, ": HTTP error ", url, ": ", err)
+		return postError{err: err, action: errorOutcome(cfg.Outcomes, err), url: url}
+	}
+	kubismus.Metric(name+"_Sent", 1, float64(cw.n))
+	cfg.stats.Sent.Add(cw.n)
+	if stop != nil {
+		recordEncoded(name, cfg, cw.n, n)
+	}
+
+	return checkResponse(name, cfg, url, resp, t, rec)
+}
+
+// encodeBatch writes the files of a batch in the given format, recording the
+// hash of each file if desired
+func encodeBatch(w io.Writer, mw *multipart.Writer, format string, files []batchFile, hash bool, hashes []string) error {
+	var tw *tar.Writer
+	switch format {
+	case BatchJSON:
+		if _, err := io.WriteString(w, "["); err != nil {
+			return err
+		}
+	case BatchTar:
+		tw = tar.NewWriter(w)
+	}
+
+	for i, f := range files {
+		fil, err := os.Open(f.fname)
+		if err != nil {
+			return err
+		}
+		var r io.Reader = fil
+		var hr *hashReader
+		if hash {
+			hr = newHashReader(fil)
+			r = hr
+		}
+
+		switch format {
+		case BatchJSON, BatchNDJSON, "":
+			err = encodeJSONEntry(w, format, i, f.inf, r)
+		case BatchMultipart:
+			h := make(textproto.MIMEHeader)
+			h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, quoteEscaper.Replace(f.inf.Name())))
+			ct := mime.TypeByExtension(filepath.Ext(f.inf.Name()))
+			if ct == "" {
+				ct = "application/octet-stream"
+			}
+			h.Set("Content-Type", ct)
+			var pw io.Writer
+			pw, err = mw.CreatePart(h)
+			if err == nil {
+				_, err = io.CopyN(pw, r, f.inf.Size())
+			}
+		case BatchTar:
+			err = tw.WriteHeader(&tar.Header{
+				Name:    f.inf.Name(),
+				Size:    f.inf.Size(),
+				Mode:    0644,
+				ModTime: f.inf.ModTime(),
+			})
+			if err == nil {
+				_, err = io.CopyN(tw, r, f.inf.Size())
+			}
+		}
+		fil.Close()
+		if err != nil {
+			return err
+		}
+		if hr != nil {
+			hashes[i] = hr.Sum(f.inf.Size())
+		}
+	}
+
+	switch format {
+	case BatchJSON:
+		_, err := io.WriteString(w, "]")
+		return err
+	case BatchMultipart:
+		return mw.Close()
+	case BatchTar:
+		return tw.Close()
+	}
+	return nil
+}
+
+// encodeJSONEntry writes one file as a JSON object, as a line or an array element
+func encodeJSONEntry(w io.Writer, format string, i int, inf os.FileInfo, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	e := batchEntry{Name: inf.Name(), Size: int64(len(data)), ModTime: inf.ModTime()}
+	if utf8.Valid(data) {
+		s := string(data)
+		e.Content = &s
+	} else {
+		e.Base64 = data
+	}
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	if format == BatchJSON {
+		if i > 0 {
+			b = append([]byte(","), b...)
+		}
+	} else {
+		b = append(b, '\n')
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// countWriter counts the bytes written through it
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
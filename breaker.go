@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ancientlore/kubismus"
+)
+
+// breaker states
+const (
+	breakerClosed   = "closed"    // posting normally
+	breakerOpen     = "open"      // endpoint is down, dispatching is paused
+	breakerHalfOpen = "half-open" // cooldown is over, waiting for a probe
+)
+
+// breaker is a circuit breaker that pauses a folder when its endpoint keeps failing
+type breaker struct {
+	mu       sync.Mutex
+	name     string
+	cfg      *FolderCfg
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	probedAt time.Time
+}
+
+// newBreaker creates a closed circuit breaker for a folder
+func newBreaker(name string, cfg *FolderCfg) *breaker {
+	b := &breaker{name: name, cfg: cfg}
+	b.setState(breakerClosed)
+	return b
+}
+
+// setState changes the state and reports it on the status page; the lock must be held
+func (b *breaker) setState(state string) {
+	b.state = state
+	kubismus.Note("breaker."+b.name, state)
+}
+
+// Allow returns whether a file may be dispatched. Once the cooldown is over it
+// allows a single probe until the probe succeeds or fails.
+func (b *breaker) Allow() bool {
+	if b.cfg.Breaker <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < time.Duration(b.cfg.Cooldown) {
+			return false
+		}
+		log.Print(b.name, ": circuit half-open, sending a probe")
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		// a probe that never reached the endpoint is given up on after another cooldown
+		if b.probing && time.Since(b.probedAt) < time.Duration(b.cfg.Cooldown) {
+			return false
+		}
+		b.probing = true
+		b.probedAt = time.Now()
+	}
+	return true
+}
+
+// State returns the state of the breaker
+func (b *breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Wait returns how long to wait before dispatching might be allowed again
+func (b *breaker) Wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if d := time.Duration(b.cfg.Cooldown) - time.Since(b.openedAt); d > 0 {
+			return d
+		}
+	}
+	return time.Duration(b.cfg.SleepTime)
+}
+
+// Success records a response from the endpoint, closing the circuit
+func (b *breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	if b.state != breakerClosed {
+		log.Print(b.name, ": circuit closed, resuming")
+		b.setState(breakerClosed)
+	}
+}
+
+// Failure records a failure to reach the endpoint, opening the circuit once there are too many in a row
+func (b *breaker) Failure() {
+	if b.cfg.Breaker <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.cfg.Breaker) {
+		log.Print(b.name, ": circuit open after ", b.failures, " failures, pausing for ", b.cfg.Cooldown)
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+		kubismus.Metric(b.name+"_BreakerOpen", 1, 0)
+	}
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"regexp"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -36,27 +40,83 @@ func (d duration) String() string {
 
 // DefaultCfg are configuration items that can be defaulted
 type DefaultCfg struct {
-	SleepTime    duration `toml:"sleep"`       // Time to wait when no files are found
-	Timeout      duration `toml:"timeout"`     // HTTP timeout
-	FilesPat     string   `toml:"files"`       // Pattern of files to look for
-	Conns        int      `toml:"conns"`       // Number of concurrent HTTP connections
-	Method       string   `toml:"method"`      // HTTP method (POST or PUT or PATCH, generally)
-	MaxFileSize  int64    `toml:"maxsize"`     // Maximum file size - larger files are moved or ignored
-	NoCompress   bool     `toml:"nocompress"`  // Disable HTTP compression
-	NoKeepAlive  bool     `toml:"nokeepalive"` // Disable HTTP keep-alive (not recommended)
-	UseRequestID string   `toml:"requestid"`   // Enable X-RequestID header
-	BatchSize    int      `toml:"batchsize"`   // Readdir batch size
-	HeaderDelim  string   `toml:"hdrdelim"`    // Header delimiter
-	HeaderText   string   `toml:"headers"`     // Text of headers
-	FileInfo     bool     `toml:"fileinfo"`    // Whether to pass file info
-	Headers      []hdr    `toml:"-"`           // Parsed headers
-}
-
-// Prints config in TOML
+	SleepTime    duration           `toml:"sleep"`        // Time to wait when no files are found
+	Timeout      duration           `toml:"timeout"`      // HTTP timeout
+	FilesPat     string             `toml:"files"`        // Pattern of files to look for
+	Conns        int                `toml:"conns"`        // Number of concurrent HTTP connections
+	Method       string             `toml:"method"`       // HTTP method (POST or PUT or PATCH, generally)
+	MaxFileSize  int64              `toml:"maxsize"`      // Maximum file size - larger files are moved or ignored
+	NoCompress   bool               `toml:"nocompress"`   // Disable HTTP compression
+	NoKeepAlive  bool               `toml:"nokeepalive"`  // Disable HTTP keep-alive (not recommended)
+	UseRequestID string             `toml:"requestid"`    // Enable X-RequestID header
+	BatchSize    int                `toml:"batchsize"`    // Readdir batch size
+	HeaderDelim  string             `toml:"hdrdelim"`     // Header delimiter
+	HeaderText   string             `toml:"headers"`      // Text of headers
+	FileInfo     bool               `toml:"fileinfo"`     // Whether to pass file info
+	Watch        string             `toml:"watch"`        // Folder watch mode (poll or inotify)
+	Rescan       duration           `toml:"rescan"`       // Full rescan interval when watching with inotify
+	Claim        bool               `toml:"claim"`        // Rename files while posting them so interrupted posts can be recovered
+	MinAge       duration           `toml:"minage"`       // Minimum time since a file was last modified
+	StableScans  int                `toml:"stablescans"`  // Number of scans a file's size and modification time must be unchanged
+	ReadyMarker  string             `toml:"readymarker"`  // Suffix of a companion file that marks a file as ready
+	Ignore       string             `toml:"ignore"`       // Comma-separated patterns of temporary files to ignore
+	Flock        bool               `toml:"flock"`        // Skip files the writer holds an advisory lock on
+	Attempts     int                `toml:"attempts"`     // Number of attempts before moving a file to movefailedto
+	Backoff      duration           `toml:"backoff"`      // Delay before the first retry, doubled on each attempt
+	MaxBackoff   duration           `toml:"maxbackoff"`   // Maximum delay between retries
+	Jitter       float64            `toml:"jitter"`       // Fraction by which retry delays are randomly varied
+	StateDir     string             `toml:"statedir"`     // Folder for state kept across restarts
+	OutcomeText  string             `toml:"outcomes"`     // Rules mapping status codes and errors to outcomes
+	Breaker      int                `toml:"breaker"`      // Consecutive failures that pause the folder (negative disables)
+	Cooldown     duration           `toml:"cooldown"`     // Time to pause the folder before probing the endpoint
+	ErrorInfo    bool               `toml:"errorinfo"`    // Write a .error.json file next to each file moved to movefailedto
+	Journal      string             `toml:"journal"`      // JSON lines file recording every post attempt
+	JournalSize  int64              `toml:"journalsize"`  // Size at which the journal is rotated
+	JournalKeep  int                `toml:"journalkeep"`  // Number of rotated journals to keep
+	URLMode      string             `toml:"urlmode"`      // How files are posted to several URLs (all, failover or roundrobin)
+	Quorum       int                `toml:"quorum"`       // Number of URLs that must accept a file in all mode (0 means all)
+	NamePattern  string             `toml:"namepattern"`  // Regular expression whose submatches of the file name are given to templates
+	MetaSuffix   string             `toml:"metasuffix"`   // Suffix of a companion file with headers, path, method and content type for a file
+	Body         string             `toml:"body"`         // How the file is sent (raw or multipart)
+	FieldName    string             `toml:"fieldname"`    // Form field of the file in multipart mode
+	FileName     string             `toml:"filename"`     // File name sent in multipart mode (a template)
+	FieldText    string             `toml:"fields"`       // Extra form fields in multipart mode, delimited like headers
+	BatchFiles   int                `toml:"batchfiles"`   // Maximum number of files posted in one request (0 or 1 disables batching)
+	BatchBytes   int64              `toml:"batchbytes"`   // Maximum size of the files posted in one request (0 means no limit)
+	BatchWait    duration           `toml:"batchwait"`    // Time to wait for more files before posting a batch
+	BatchFormat  string             `toml:"batchformat"`  // Encoding of a batch (ndjson, json, multipart or tar)
+	Upload       string             `toml:"upload"`       // How large files are uploaded in chunks (range or tus; empty disables chunking)
+	ChunkSize    int64              `toml:"chunksize"`    // Size of the chunks of a chunked upload; larger files are chunked
+	Encode       string             `toml:"encode"`       // Compression of request bodies (gzip, zstd or deflate; empty disables it)
+	EncodeSkip   string             `toml:"encodeskip"`   // Comma-separated extensions of files that are not compressed
+	CAFile       string             `toml:"cafile"`       // PEM bundle of CAs trusted besides the system's
+	CertFile     string             `toml:"certfile"`     // PEM client certificate, reloaded when it changes
+	KeyFile      string             `toml:"keyfile"`      // PEM key of the client certificate
+	TLSMin       string             `toml:"tlsmin"`       // Minimum TLS version (1.0, 1.1, 1.2 or 1.3)
+	ServerName   string             `toml:"servername"`   // Server name to verify and send with SNI instead of the URL's host
+	Insecure     bool               `toml:"insecure"`     // Skip verifying server certificates (for testing only)
+	Proxy        string             `toml:"proxy"`        // Proxy URL (http, https, socks5 or socks5h), or "environment"
+	Auth         string             `toml:"auth"`         // Authentication (basic, bearer or oauth2; empty disables it)
+	Username     string             `toml:"username"`     // User name for basic auth
+	Password     string             `toml:"password"`     // Password for basic auth
+	TokenFile    string             `toml:"tokenfile"`    // File holding the bearer token, read again when it changes
+	TokenURL     string             `toml:"tokenurl"`     // OAuth2 token endpoint
+	ClientID     string             `toml:"clientid"`     // OAuth2 client ID
+	ClientSecret string             `toml:"clientsecret"` // OAuth2 client secret
+	Scopes       string             `toml:"scopes"`       // OAuth2 scopes, separated by commas or spaces
+	Headers      []hdr              `toml:"-"`            // Parsed headers
+	Outcomes     []outcomeRule      `toml:"-"`            // Parsed outcome rules
+	Fields       []hdr              `toml:"-"`            // Parsed form fields
+	FileNameTmpl *template.Template `toml:"-"`            // Parsed file name template
+}
+
+// Prints config in TOML, without secrets
 func (c *DefaultCfg) String() string {
 	var b bytes.Buffer
 	enc := toml.NewEncoder(&b)
-	err := enc.Encode(c)
+	cp := *c
+	cp.redact()
+	err := enc.Encode(&cp)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -73,6 +133,25 @@ func (c *DefaultCfg) Init() {
 	c.Timeout = duration(10 * time.Second)
 	c.SleepTime = duration(time.Second)
 	c.HeaderDelim = "|"
+	c.Watch = "poll"
+	c.Rescan = duration(time.Minute)
+	c.MinAge = duration(time.Second)
+	c.Attempts = 1
+	c.Backoff = duration(time.Second)
+	c.MaxBackoff = duration(5 * time.Minute)
+	c.Jitter = 0.2
+	c.Breaker = 5
+	c.Cooldown = duration(30 * time.Second)
+	c.JournalSize = 10 * 1024 * 1024
+	c.JournalKeep = 5
+	c.URLMode = URLModeAll
+	c.Body = BodyRaw
+	c.FieldName = "file"
+	c.FileName = "{{.Name}}"
+	c.BatchWait = duration(time.Second)
+	c.BatchFormat = BatchNDJSON
+	c.ChunkSize = 4 * 1024 * 1024
+	c.EncodeSkip = defaultEncodeSkip
 }
 
 // ParseHeaders parses the header text
@@ -82,19 +161,97 @@ func (c *DefaultCfg) ParseHeaders() error {
 	return err
 }
 
+// ParseOutcomes parses the outcome rules, adding the default rules after them
+func (c *DefaultCfg) ParseOutcomes() error {
+	rules, err := parseOutcomes(c.OutcomeText)
+	if err != nil {
+		return err
+	}
+	defaults, err := parseOutcomes(defaultOutcomes)
+	if err != nil {
+		return err
+	}
+	c.Outcomes = append(rules, defaults...)
+	return nil
+}
+
+// ParseFields checks the body, batch and upload modes and the encoding and
+// parses the form fields and file name
+func (c *DefaultCfg) ParseFields() error {
+	switch c.Body {
+	case BodyRaw, BodyMultipart:
+	default:
+		return fmt.Errorf("unknown body mode %q", c.Body)
+	}
+	switch c.BatchFormat {
+	case BatchNDJSON, BatchJSON, BatchMultipart, BatchTar:
+	default:
+		return fmt.Errorf("unknown batch format %q", c.BatchFormat)
+	}
+	switch c.Upload {
+	case "", UploadRange, UploadTus:
+	default:
+		return fmt.Errorf("unknown upload mode %q", c.Upload)
+	}
+	if err := checkEncode(c.Encode); err != nil {
+		return err
+	}
+	var err error
+	c.Fields, err = parseHeaders(c.FieldText, c.HeaderDelim)
+	if err != nil {
+		return err
+	}
+	c.FileNameTmpl, err = parseTemplate("filename", c.FileName)
+	return err
+}
+
 // FolderCfg are config items for a folder
 type FolderCfg struct {
-	DefaultCfg                   // defaultable config settings
-	Folder       string          `toml:"folder"`       // folder to watch
-	URL          string          `toml:"url"`          // URL to post to
-	MoveTo       string          `toml:"moveto"`       // folder to move files to after posting (otherwise deletes)
-	MoveFailedTo string          `toml:"movefailedto"` // folder to move files that we cannot post
-	client       *http.Client    `toml:"-"`            // http client for this folder
-	transport    *http.Transport `toml:"-"`            // http transport for this folder
+	DefaultCfg                        // defaultable config settings
+	Folder       string               `toml:"folder"`       // folder to watch
+	URL          string               `toml:"url"`          // URL to post to
+	URLs         []string             `toml:"urls"`         // more URLs to post to, according to urlmode
+	MoveTo       string               `toml:"moveto"`       // folder to move files to after posting (otherwise deletes)
+	MoveFailedTo string               `toml:"movefailedto"` // folder to move files that we cannot post
+	client       *http.Client         `toml:"-"`            // http client for this folder
+	transport    *http.Transport      `toml:"-"`            // http transport for this folder
+	tlsConfig    *tls.Config          `toml:"-"`            // TLS settings of the transport, nil for the defaults
+	proxy        proxyFunc            `toml:"-"`            // proxy of the transport, nil to connect directly
+	auth         authenticator        `toml:"-"`            // credentials of requests, nil for none
+	inflight     *inFlight            `toml:"-"`            // files dispatched to posters
+	retries      *retryState          `toml:"-"`            // files waiting to be retried
+	uploads      *uploadState         `toml:"-"`            // chunked uploads in progress
+	breaker      *breaker             `toml:"-"`            // pauses the folder when the endpoint is down
+	stats        *folderStats         `toml:"-"`            // running totals
+	journal      *journal             `toml:"-"`            // audit journal of post attempts
+	next         uint64               `toml:"-"`            // posts started, for picking URLs in roundrobin mode
+	nameRe       *regexp.Regexp       `toml:"-"`            // compiled namepattern
+	urlTemplates []*template.Template `toml:"-"`            // templates of the URLs, nil for plain URLs
+	control      *folderControl       `toml:"-"`            // pause and rescan requests from the admin API
 }
 
-// Prints config in TOML
+// Prints config in TOML, without secrets
 func (c *FolderCfg) String() string {
+	cp := c.settings()
+	cp.redact()
+	return cp.encode()
+}
+
+// settings returns a copy of the settings from the config file, leaving out
+// the running state that posters change
+func (c *FolderCfg) settings() FolderCfg {
+	return FolderCfg{
+		DefaultCfg:   c.DefaultCfg,
+		Folder:       c.Folder,
+		URL:          c.URL,
+		URLs:         c.URLs,
+		MoveTo:       c.MoveTo,
+		MoveFailedTo: c.MoveFailedTo,
+	}
+}
+
+// encode returns the config in TOML, secrets included, for telling whether it changed
+func (c *FolderCfg) encode() string {
 	var b bytes.Buffer
 	enc := toml.NewEncoder(&b)
 	err := enc.Encode(c)
@@ -145,6 +302,159 @@ func (c *FolderCfg) SetDefaults(from *DefaultCfg) {
 	if c.FileInfo == false {
 		c.FileInfo = from.FileInfo
 	}
+	if c.Watch == "" {
+		c.Watch = from.Watch
+	}
+	if c.Rescan == duration(0) {
+		c.Rescan = from.Rescan
+	}
+	if c.Claim == false {
+		c.Claim = from.Claim
+	}
+	if c.MinAge == duration(0) {
+		c.MinAge = from.MinAge
+	}
+	if c.StableScans == 0 {
+		c.StableScans = from.StableScans
+	}
+	if c.ReadyMarker == "" {
+		c.ReadyMarker = from.ReadyMarker
+	}
+	if c.Ignore == "" {
+		c.Ignore = from.Ignore
+	}
+	if c.Flock == false {
+		c.Flock = from.Flock
+	}
+	if c.Attempts == 0 {
+		c.Attempts = from.Attempts
+	}
+	if c.Backoff == duration(0) {
+		c.Backoff = from.Backoff
+	}
+	if c.MaxBackoff == duration(0) {
+		c.MaxBackoff = from.MaxBackoff
+	}
+	if c.Jitter == 0 {
+		c.Jitter = from.Jitter
+	}
+	if c.StateDir == "" {
+		c.StateDir = from.StateDir
+	}
+	if c.OutcomeText == "" {
+		c.OutcomeText = from.OutcomeText
+	}
+	if c.Breaker == 0 {
+		c.Breaker = from.Breaker
+	}
+	if c.Cooldown == duration(0) {
+		c.Cooldown = from.Cooldown
+	}
+	if c.ErrorInfo == false {
+		c.ErrorInfo = from.ErrorInfo
+	}
+	if c.Journal == "" {
+		c.Journal = from.Journal
+	}
+	if c.JournalSize == 0 {
+		c.JournalSize = from.JournalSize
+	}
+	if c.JournalKeep == 0 {
+		c.JournalKeep = from.JournalKeep
+	}
+	if c.URLMode == "" {
+		c.URLMode = from.URLMode
+	}
+	if c.Quorum == 0 {
+		c.Quorum = from.Quorum
+	}
+	if c.NamePattern == "" {
+		c.NamePattern = from.NamePattern
+	}
+	if c.MetaSuffix == "" {
+		c.MetaSuffix = from.MetaSuffix
+	}
+	if c.Body == "" {
+		c.Body = from.Body
+	}
+	if c.FieldName == "" {
+		c.FieldName = from.FieldName
+	}
+	if c.FileName == "" {
+		c.FileName = from.FileName
+	}
+	if c.FieldText == "" {
+		c.FieldText = from.FieldText
+	}
+	if c.BatchFiles == 0 {
+		c.BatchFiles = from.BatchFiles
+	}
+	if c.BatchBytes == 0 {
+		c.BatchBytes = from.BatchBytes
+	}
+	if c.BatchWait == duration(0) {
+		c.BatchWait = from.BatchWait
+	}
+	if c.BatchFormat == "" {
+		c.BatchFormat = from.BatchFormat
+	}
+	if c.Upload == "" {
+		c.Upload = from.Upload
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = from.ChunkSize
+	}
+	if c.Encode == "" {
+		c.Encode = from.Encode
+	}
+	if c.EncodeSkip == "" {
+		c.EncodeSkip = from.EncodeSkip
+	}
+	if c.CAFile == "" {
+		c.CAFile = from.CAFile
+	}
+	if c.CertFile == "" {
+		c.CertFile = from.CertFile
+	}
+	if c.KeyFile == "" {
+		c.KeyFile = from.KeyFile
+	}
+	if c.TLSMin == "" {
+		c.TLSMin = from.TLSMin
+	}
+	if c.ServerName == "" {
+		c.ServerName = from.ServerName
+	}
+	if c.Insecure == false {
+		c.Insecure = from.Insecure
+	}
+	if c.Proxy == "" {
+		c.Proxy = from.Proxy
+	}
+	if c.Auth == "" {
+		c.Auth = from.Auth
+	}
+	if c.Username == "" {
+		c.Username = from.Username
+	}
+	if c.Password == "" {
+		c.Password = from.Password
+	}
+	if c.TokenFile == "" {
+		c.TokenFile = from.TokenFile
+	}
+	if c.TokenURL == "" {
+		c.TokenURL = from.TokenURL
+	}
+	if c.ClientID == "" {
+		c.ClientID = from.ClientID
+	}
+	if c.ClientSecret == "" {
+		c.ClientSecret = from.ClientSecret
+	}
+	if c.Scopes == "" {
+		c.Scopes = from.Scopes
+	}
 }
 
 // header mode
@@ -158,9 +468,10 @@ const (
 
 // header structure
 type hdr struct {
-	Key   string
-	Value string
-	Mode  hdrMode
+	Key      string
+	Value    string
+	Mode     hdrMode
+	Template *template.Template // template of the value, nil for plain values
 }
 
 // parseHeaders parses the header text with the given delimiter
@@ -176,6 +487,11 @@ func parseHeaders(headerText, headerDelim string) ([]hdr, error) {
 				return nil, errors.New("Unable to parse header: " + h)
 			}
 			newHdr := hdr{Key: strings.TrimSpace(harr[0]), Value: strings.TrimSpace(harr[1])}
+			t, err := parseTemplate(newHdr.Key, newHdr.Value)
+			if err != nil {
+				return nil, err
+			}
+			newHdr.Template = t
 			_, ok := found[newHdr.Key]
 			if !ok {
 				found[newHdr.Key] = true
@@ -206,3 +522,48 @@ func readConfig(fn string) (map[string]*FolderCfg, error) {
 	}
 	return c.Folders, nil
 }
+
+// loadFolders reads the folder data from the config file, filling in defaults
+// and parsing the settings of each folder
+func loadFolders(fn string, defaults *DefaultCfg) (map[string]*FolderCfg, error) {
+	cfg, err := readConfig(fn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cfg {
+		cfg[i].SetDefaults(defaults)
+		err = cfg[i].ParseHeaders()
+		if err != nil {
+			return nil, err
+		}
+		err = cfg[i].ParseOutcomes()
+		if err != nil {
+			return nil, err
+		}
+		err = cfg[i].ParseFields()
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %w", i, err)
+		}
+		err = cfg[i].CheckTargets()
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %w", i, err)
+		}
+		err = cfg[i].ParseTemplates()
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %w", i, err)
+		}
+		err = cfg[i].LoadTLS()
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %w", i, err)
+		}
+		err = cfg[i].ParseProxy()
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %w", i, err)
+		}
+		err = cfg[i].ParseAuth()
+		if err != nil {
+			return nil, fmt.Errorf("folder %s: %w", i, err)
+		}
+	}
+	return cfg, nil
+}
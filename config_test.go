@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFolderCfgString(t *testing.T) {
+	cfg := &FolderCfg{URL: "http://x/", MoveFailedTo: "/failed"}
+	cfg.Init()
+	cfg.Auth = AuthBasic
+	cfg.Username = "user"
+	cfg.Password = "secret"
+	cfg.URLMode = URLModeRoundRobin
+
+	// posters pick URLs while the status page prints the config
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			atomic.AddUint64(&cfg.next, 1)
+		}
+	}()
+	s := cfg.String()
+	<-done
+
+	if !strings.Contains(s, `password = "`+secretMask+`"`) {
+		t.Errorf("password not masked:\n%s", s)
+	}
+	if !strings.Contains(s, `movefailedto = "/failed"`) {
+		t.Errorf("folder settings missing:\n%s", s)
+	}
+	if cfg.Password != "secret" {
+		t.Error("String changed the config")
+	}
+	if !strings.Contains(cfg.encode(), `password = "secret"`) {
+		t.Error("encode left out the password")
+	}
+}
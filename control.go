@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// pausedWait is how long a paused folder sleeps if nothing wakes it up
+const pausedWait = time.Hour
+
+// folderControl holds requests made through the admin API to a folder's scanner
+type folderControl struct {
+	paused atomic.Bool
+	wake   chan struct{} // signals the scanner to rescan now
+}
+
+// newFolderControl creates the control of a running folder
+func newFolderControl() *folderControl {
+	return &folderControl{wake: make(chan struct{}, 1)}
+}
+
+// Pause stops dispatching files; posts in progress are finished
+func (c *folderControl) Pause() {
+	c.paused.Store(true)
+}
+
+// Resume starts dispatching files again
+func (c *folderControl) Resume() {
+	c.paused.Store(false)
+	c.Rescan()
+}
+
+// Paused returns whether the folder is paused
+func (c *folderControl) Paused() bool {
+	return c.paused.Load()
+}
+
+// Rescan wakes up the scanner so that it scans the folder without waiting
+func (c *folderControl) Rescan() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+		// a rescan is already requested
+	}
+}
+
+// Wake returns the channel that signals a requested rescan
+func (c *folderControl) Wake() <-chan struct{} {
+	return c.wake
+}
+
+// requeueFiles moves files matching a pattern from movefailedto back into the
+// folder, forgetting their failed attempts, and returns the names moved
+func requeueFiles(name string, cfg *FolderCfg, match string) ([]string, error) {
+	if cfg.MoveFailedTo == "" {
+		return nil, errors.New("no movefailedto folder configured")
+	}
+	if match == "" {
+		match = "*"
+	}
+	if _, err := filepath.Match(match, ""); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(cfg.MoveFailedTo)
+	if err != nil {
+		return nil, err
+	}
+	moved := []string{}
+	for _, ent := range entries {
+		fn := ent.Name()
+		if !ent.Type().IsRegular() || isFailureInfo(fn) || isClaimed(fn) || isMeta(cfg, fn) {
+			continue
+		}
+		if matched, _ := filepath.Match(match, fn); !matched {
+			continue
+		}
+		src := filepath.Join(cfg.MoveFailedTo, fn)
+		dst := filepath.Join(cfg.Folder, fn)
+		if _, err := os.Lstat(dst); err == nil {
+			log.Print(name, ": Not requeuing ", src, ", ", dst, " already exists")
+			continue
+		}
+		// forget earlier attempts before the scanner can see the file
+		cfg.retries.Done(fn)
+		// the metadata goes first so that it is there when the file is posted
+		moveMeta(name, cfg, cfg.MoveFailedTo, fn, cfg.Folder)
+		if err := os.Rename(src, dst); err != nil {
+			log.Print(name, ": Unable to requeue ", src, ": ", err)
+			moveMeta(name, cfg, cfg.Folder, fn, cfg.MoveFailedTo)
+			continue
+		}
+		err := os.Remove(src + failureSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			log.Print(name, ": Unable to remove failure info for ", src, ": ", err)
+		}
+		moved = append(moved, fn)
+	}
+	if len(moved) > 0 {
+		log.Print(name, ": requeued ", len(moved), " files from ", cfg.MoveFailedTo)
+		cfg.control.Rescan()
+	}
+	return moved, nil
+}
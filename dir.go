@@ -6,79 +6,272 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
 	"time"
-)
 
-type fileInfoSlice []os.FileInfo
+	"github.com/ancientlore/kubismus"
+)
 
-func (fi fileInfoSlice) Len() int           { return len(fi) }
-func (fi fileInfoSlice) Swap(i, j int)      { fi[i], fi[j] = fi[j], fi[i] }
-func (fi fileInfoSlice) Less(i, j int) bool { return fi[i].Name() < fi[j].Name() }
+// watcher reports the names of files that become ready in a folder
+type watcher interface {
+	Events() <-chan string
+	Close() error
+}
 
 func readDir(ctx context.Context, name string, cfg *FolderCfg) <-chan os.FileInfo {
 	done := ctx.Done()
 	out := make(chan os.FileInfo)
+
+	// put back files from an interrupted run
+	if cfg.Claim {
+		recoverClaims(name, cfg)
+	}
+
+	// set up the folder watcher if requested
+	var w watcher
+	var events <-chan string
+	switch cfg.Watch {
+	case "inotify":
+		if once {
+			// a single run only needs scans
+			break
+		}
+		var err error
+		w, err = newWatcher(cfg.Folder)
+		if err != nil {
+			log.Print(name, ": Unable to watch folder, polling instead: ", cfg.Folder, " ", err)
+		} else {
+			events = w.Events()
+		}
+	case "poll", "":
+	default:
+		log.Print(name, ": Unknown watch mode ", cfg.Watch, ", polling instead")
+	}
+
 	looper := func() {
 		defer close(out)
-		var lastInfo = make([]os.FileInfo, 0)
+		if w != nil {
+			defer w.Close()
+		}
+
+		// The directory handle is kept open between batches so that each batch
+		// continues where the previous one stopped. It is only reopened once the
+		// whole directory has been read, so folders larger than BatchSize cannot
+		// starve the files at the end.
+		var fil *os.File
+		defer func() {
+			if fil != nil {
+				fil.Close()
+			}
+		}()
+
+		var backlog int
+		var oldest time.Time // modification time of the oldest file in the backlog
+		var sent bool
+		var held bool             // files were not ready yet
+		var recheck time.Duration // shortest wait until a file that was not ready may be
+
+		// files reported by the watcher that were not ready yet
+		var pending bool
+		rd := newReadiness(name, cfg)
+
 		for {
 			var wait time.Duration
-			fil, err := os.Open(cfg.Folder)
-			if err != nil {
-				log.Print(name, ": Unable to open folder: ", cfg.Folder, " ", err)
-				return
+			var paused bool
+			if fil == nil {
+				var err error
+				fil, err = os.Open(cfg.Folder)
+				if err != nil {
+					log.Print(name, ": Unable to open folder: ", cfg.Folder, " ", err)
+					return
+				}
+			}
+			entries, err := fil.ReadDir(cfg.BatchSize)
+			for _, ent := range entries {
+				// Don't send directories or anything else that isn't a plain file
+				if !ent.Type().IsRegular() {
+					continue
+				}
+				// match file pattern, counting files claimed by a poster under their original name
+				fn := strings.TrimSuffix(ent.Name(), claimSuffix)
+				if matched, _ := filepath.Match(cfg.FilesPat, fn); !matched {
+					continue
+				}
+				// skip temporary files and ready markers
+				if rd.Skip(fn) {
+					continue
+				}
+				inf, err := ent.Info()
+				if err != nil {
+					// most likely removed since the folder was read
+					if !os.IsNotExist(err) {
+						log.Print(name, ": Unable to stat file: ", ent.Name(), " ", err)
+					}
+					continue
+				}
+				backlog++
+				if oldest.IsZero() || inf.ModTime().Before(oldest) {
+					oldest = inf.ModTime()
+				}
+				// failed files wait for their next retry
+				due := cfg.retries.Due(fn)
+				if fn != ent.Name() || !due {
+					continue
+				}
+				// never send a file that a poster still holds
+				if !cfg.inflight.Claim(ent.Name()) {
+					continue
+				}
+				// wait until the writer is finished with the file
+				if !rd.Ready(inf) {
+					cfg.inflight.Release(ent.Name())
+					if d := rd.Recheck(inf); !held || d < recheck {
+						recheck = d
+					}
+					held = true
+					continue
+				}
+				// stop dispatching while paused or the endpoint is down
+				if cfg.control.Paused() || !cfg.breaker.Allow() {
+					cfg.inflight.Release(ent.Name())
+					paused = true
+					break
+				}
+				// send along the file, unless stopped since the last check
+				if ctx.Err() != nil {
+					cfg.inflight.Release(ent.Name())
+					return
+				}
+				select {
+				case out <- inf:
+					sent = true
+				case <-done:
+					cfg.inflight.Release(ent.Name())
+					return
+				}
 			}
-			info, err := fil.Readdir(cfg.BatchSize)
-			fil.Close()
-			if err == io.EOF {
-				if info == nil || len(info) == 0 {
+			if paused {
+				// a single run gives up on an endpoint that is down, unless failed
+				// files are still waiting for a retry
+				if once && !cfg.control.Paused() && cfg.inflight.Len() == 0 && !retriesPending(cfg) {
+					return
+				}
+				// start the pass over once the endpoint is back or the folder is resumed
+				fil.Close()
+				fil = nil
+				backlog = 0
+				oldest = time.Time{}
+				sent = false
+				held = false
+				wait = cfg.breaker.Wait()
+				if cfg.control.Paused() {
+					wait = pausedWait
+				}
+			} else if err == io.EOF || (err == nil && len(entries) == 0) {
+				// finished a full pass of the folder
+				fil.Close()
+				fil = nil
+				kubismus.Metric(name+"_Backlog", 1, float64(backlog))
+				cfg.stats.EndPass(backlog, oldest)
+				rd.EndPass()
+				cfg.retries.EndPass()
+				if !sent {
 					wait = time.Duration(cfg.SleepTime)
+					if once {
+						if held {
+							// scan again once the files that were not ready may be
+							if recheck < wait {
+								wait = recheck
+							}
+						} else if cfg.inflight.Len() == 0 && !retriesPending(cfg) {
+							// nothing left to send, so stop once the posters are finished
+							// and no failed file is waiting for a retry
+							return
+						}
+					}
 				}
+				backlog = 0
+				oldest = time.Time{}
+				sent = false
+				held = false
 			} else if err != nil {
 				log.Print(name, ": Error reading folder: ", cfg.Folder, " ", err)
+				fil.Close()
+				fil = nil
 				wait = 10 * time.Second
-			} else {
-				wait = time.Duration(cfg.SleepTime)
-				for _, inf := range info {
-					// Don't send directories
-					if !inf.IsDir() {
-						// match file pattern
-						if matched, _ := filepath.Match(cfg.FilesPat, inf.Name()); matched {
-							// check if we saw the file last time
-							loc := sort.Search(len(lastInfo), func(i int) bool {
-								return lastInfo[i].Name() >= inf.Name()
-							})
-							// new file not in list
-							if loc >= len(lastInfo) || (loc < len(lastInfo) && lastInfo[loc].Name() != inf.Name()) {
-								// send along the file
-								select {
-								case out <- inf:
-									wait = 0
-								case <-done:
-									return
-								}
-							} else if inf.ModTime().Before(time.Now().Add(-time.Minute)) {
-								// send along the file - handle very old files that for some reason are still there
-								select {
-								case out <- inf:
-								case <-done:
-									return
-								}
-							}
-						}
-					}
+			}
+			if wait > 0 && events != nil && wait == time.Duration(cfg.SleepTime) && !pending {
+				// events drive the work, so only fall back to a full rescan occasionally
+				wait = time.Duration(cfg.Rescan)
+			}
+			pending = false
+			if next := cfg.retries.NextDue(); wait > 0 && !paused && !next.IsZero() && time.Until(next) < wait {
+				// wake up in time for the next retry
+				wait = time.Until(next)
+				if wait < 0 {
+					wait = 0
 				}
-				lastInfo = info
-				sort.Sort(fileInfoSlice(lastInfo))
 			}
 			if wait > 0 {
 				// log.Print(name, ": Waiting ", wait.String())
+				deadline := time.Now().Add(wait)
 				c := time.After(wait)
-				select {
-				case <-done:
-					return
-				case <-c:
+				// wakeBy shortens the wait so that the folder is scanned again within d
+				wakeBy := func(d time.Duration) {
+					pending = true
+					if at := time.Now().Add(d); at.Before(deadline) {
+						deadline = at
+						c = time.After(d)
+					}
+				}
+			waitLoop:
+				for {
+					select {
+					case <-done:
+						return
+					case <-c:
+						break waitLoop
+					case <-cfg.control.Wake():
+						// rescan requested through the admin API
+						break waitLoop
+					case fn, ok := <-events:
+						if !ok {
+							// watcher failed; revert to polling
+							log.Print(name, ": Folder watch stopped, polling instead: ", cfg.Folder)
+							events = nil
+							break waitLoop
+						}
+						if cfg.control.Paused() {
+							// a rescan picks the file up once the folder is resumed
+							continue
+						}
+						inf, ok := watchedFile(name, cfg, rd, fn)
+						if !ok || !cfg.retries.Due(inf.Name()) || !cfg.inflight.Claim(inf.Name()) {
+							continue
+						}
+						if !rd.Ready(inf) {
+							// not finished yet, so check again once it may be
+							cfg.inflight.Release(inf.Name())
+							wakeBy(rd.Recheck(inf))
+							continue
+						}
+						if !cfg.breaker.Allow() {
+							// the endpoint is down; a rescan picks the file up later
+							cfg.inflight.Release(inf.Name())
+							wakeBy(cfg.breaker.Wait())
+							continue
+						}
+						if ctx.Err() != nil {
+							cfg.inflight.Release(inf.Name())
+							return
+						}
+						select {
+						case out <- inf:
+						case <-done:
+							cfg.inflight.Release(inf.Name())
+							return
+						}
+					}
 				}
 			}
 		}
@@ -87,3 +280,35 @@ func readDir(ctx context.Context, name string, cfg *FolderCfg) <-chan os.FileInf
 	go looper()
 	return out
 }
+
+// retriesPending returns whether a single run has to wait for failed files to
+// be retried. Without movefailedto they are retried forever, so it does not.
+func retriesPending(cfg *FolderCfg) bool {
+	return cfg.MoveFailedTo != "" && !cfg.retries.NextDue().IsZero()
+}
+
+// watchedFile returns the file info for a file reported by the watcher, if it should be sent
+func watchedFile(name string, cfg *FolderCfg, rd *readiness, fn string) (os.FileInfo, bool) {
+	// a new ready marker means its file may be ready
+	if cfg.ReadyMarker != "" {
+		fn = strings.TrimSuffix(fn, cfg.ReadyMarker)
+	}
+	if isClaimed(fn) || rd.Skip(fn) {
+		return nil, false
+	}
+	if matched, _ := filepath.Match(cfg.FilesPat, fn); !matched {
+		return nil, false
+	}
+	inf, err := os.Lstat(filepath.Join(cfg.Folder, fn))
+	if err != nil {
+		// already gone, most likely picked up by a rescan
+		if !os.IsNotExist(err) {
+			log.Print(name, ": Unable to stat file: ", fn, " ", err)
+		}
+		return nil, false
+	}
+	if !inf.Mode().IsRegular() {
+		return nil, false
+	}
+	return inf, true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFolder returns the config of a folder holding the given files
+func testFolder(t *testing.T, files ...string) *FolderCfg {
+	cfg := &FolderCfg{Folder: t.TempDir()}
+	cfg.Init()
+	cfg.StateDir = t.TempDir()
+	cfg.stats = new(folderStats)
+	cfg.control = newFolderControl()
+	cfg.inflight = newInFlight()
+	cfg.retries = newRetryState("test", cfg)
+	cfg.breaker = newBreaker("test", cfg)
+	for _, fn := range files {
+		if err := ioutil.WriteFile(filepath.Join(cfg.Folder, fn), []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+// readOnce runs a single pass of readDir, posting each file by removing it,
+// and returns the names of the files sent
+func readOnce(t *testing.T, cfg *FolderCfg) []string {
+	once = true
+	defer func() { once = false }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var sent []string
+	ch := readDir(ctx, "test", cfg)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case inf, ok := <-ch:
+			if !ok {
+				sort.Strings(sent)
+				return sent
+			}
+			sent = append(sent, inf.Name())
+			os.Remove(filepath.Join(cfg.Folder, inf.Name()))
+			cfg.inflight.Release(inf.Name())
+		case <-timeout:
+			t.Fatalf("single run did not finish, sent %v", sent)
+		}
+	}
+}
+
+func TestReadDirOnceMinAge(t *testing.T) {
+	cfg := testFolder(t, "a.txt", "b.txt")
+	cfg.MinAge = duration(300 * time.Millisecond)
+	cfg.SleepTime = duration(time.Minute)
+
+	start := time.Now()
+	if got := strings.Join(readOnce(t, cfg), ","); got != "a.txt,b.txt" {
+		t.Errorf("sent %q, want both files", got)
+	}
+	// files are checked again once they reach minage, not after sleeptime
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %s", d)
+	}
+}
+
+func TestReadDirOnceStableScans(t *testing.T) {
+	cfg := testFolder(t, "a.txt", "b.txt")
+	cfg.MinAge = 0
+	cfg.StableScans = 2
+	cfg.SleepTime = duration(20 * time.Millisecond)
+
+	if got := strings.Join(readOnce(t, cfg), ","); got != "a.txt,b.txt" {
+		t.Errorf("sent %q, want both files", got)
+	}
+}
+
+func TestReadDirOnceEmpty(t *testing.T) {
+	cfg := testFolder(t)
+	if got := readOnce(t, cfg); len(got) != 0 {
+		t.Errorf("sent %v from an empty folder", got)
+	}
+}
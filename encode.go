@@ -0,0 +1,84 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// request body encodings
+const (
+	EncodeGzip    = "gzip"
+	EncodeZstd    = "zstd"
+	EncodeDeflate = "deflate" // zlib data, as HTTP defines deflate
+)
+
+// defaultEncodeSkip are extensions of files that are already compressed
+const defaultEncodeSkip = ".gz,.tgz,.zst,.zip,.bz2,.xz,.7z,.br,.lz4,.jpg,.jpeg,.png,.gif,.webp,.mp3,.mp4,.mov,.pdf"
+
+// checkEncode checks the request body encoding
+func checkEncode(encoding string) error {
+	switch encoding {
+	case "", EncodeGzip, EncodeZstd, EncodeDeflate:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %q", encoding)
+}
+
+// encoded returns whether a file is compressed when posted
+func encoded(cfg *FolderCfg, inf os.FileInfo) bool {
+	if cfg.Encode == "" {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(inf.Name()))
+	for _, s := range strings.Split(cfg.EncodeSkip, ",") {
+		if s = strings.ToLower(strings.TrimSpace(s)); s != "" && s == ext {
+			return false
+		}
+	}
+	return true
+}
+
+// compressor returns a writer that compresses to w in the given encoding
+func compressor(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodeGzip:
+		return gzip.NewWriter(w), nil
+	case EncodeZstd:
+		return zstd.NewWriter(w)
+	case EncodeDeflate:
+		return zlib.NewWriter(w), nil
+	}
+	return nil, checkEncode(encoding)
+}
+
+// compressBody streams r through a compressor. The returned function stops
+// the compressor once the request is done and returns the number of
+// compressed bytes sent.
+func compressBody(r io.Reader, encoding string) (io.ReadCloser, func() int64) {
+	pr, pw := io.Pipe()
+	cw := &countWriter{w: pw}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		zw, err := compressor(cw, encoding)
+		if err == nil {
+			_, err = io.Copy(zw, r)
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, func() int64 {
+		pr.Close()
+		<-done
+		return cw.n
+	}
+}
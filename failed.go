@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// failureSuffix is appended to the name of a quarantined file to name its failure sidecar
+const failureSuffix = ".error.json"
+
+// failureInfo describes why a file was moved to movefailedto
+type failureInfo struct {
+	Folder       string     `json:"folder"`                 // name of the folder configuration
+	File         string     `json:"file"`                   // name of the file
+	Size         int64      `json:"size"`                   // size of the file
+	ModTime      time.Time  `json:"modTime"`                // modification time of the file
+	URL          string     `json:"url"`                    // URL the file was posted to
+	Method       string     `json:"method"`                 // HTTP method used
+	Reason       string     `json:"reason"`                 // why the file was quarantined (oversized, fail or retry)
+	Status       int        `json:"status,omitempty"`       // HTTP status code of the last attempt
+	Error        string     `json:"error"`                  // error text of the last attempt
+	Response     string     `json:"response,omitempty"`     // start of the response body of the last attempt
+	Attempts     int        `json:"attempts"`               // number of attempts made
+	FirstFailure *time.Time `json:"firstFailure,omitempty"` // time of the first failed attempt
+	LastFailure  *time.Time `json:"lastFailure,omitempty"`  // time of the last failed attempt
+	Quarantined  time.Time  `json:"quarantined"`            // time the file was moved
+}
+
+// writeFailureInfo writes the failure sidecar next to a quarantined file, if enabled
+func writeFailureInfo(name string, cfg *FolderCfg, inf os.FileInfo, newFname string, fi failureInfo) {
+	if !cfg.ErrorInfo {
+		return
+	}
+	fi.Folder = name
+	fi.File = inf.Name()
+	fi.Size = inf.Size()
+	fi.ModTime = inf.ModTime()
+	if fi.URL == "" {
+		fi.URL = strings.Join(cfg.Targets(), " ")
+	}
+	fi.Method = cfg.Method
+	fi.Quarantined = time.Now()
+	data, err := json.MarshalIndent(&fi, "", "\t")
+	if err != nil {
+		log.Print(name, ": Unable to encode failure info for ", inf.Name(), ": ", err)
+		return
+	}
+	err = writeFileAtomic(newFname+failureSuffix, data)
+	if err != nil {
+		log.Print(name, ": Unable to write failure info for ", inf.Name(), ": ", err)
+	}
+}
+
+// isFailureInfo returns whether a file name is a failure sidecar
+func isFailureInfo(fn string) bool {
+	return strings.HasSuffix(fn, failureSuffix)
+}
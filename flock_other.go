@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "errors"
+
+// isLocked is not available on this platform
+func isLocked(fname string) (bool, error) {
+	return false, errors.New("advisory locks are not supported on this platform")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ancientlore/kubismus"
+)
+
+// folderRunner is the running pipeline of one folder
+type folderRunner struct {
+	name   string
+	cfg    *FolderCfg
+	cancel context.CancelFunc // stops dispatching files
+	abort  context.CancelFunc // cancels posts in progress
+	done   chan struct{}      // closed when the posters are finished
+}
+
+// stop stops dispatching files and waits for posts in progress, canceling
+// them if they take longer than the drain timeout
+func (r *folderRunner) stop(drain time.Duration) {
+	r.cancel()
+	t := time.NewTimer(drain)
+	defer t.Stop()
+	select {
+	case <-r.done:
+	case <-t.C:
+		log.Print(r.name, ": posts still in progress after ", drain, ", canceling them")
+		r.abort()
+		<-r.done
+	}
+	r.abort()
+}
+
+// folderManager starts and stops the pipelines of the configured folders
+type folderManager struct {
+	reload  sync.Mutex // held during a reload so that reloads do not overlap
+	mu      sync.Mutex
+	folders map[string]*folderRunner
+	stopped bool                      // set by StopAll so that a reload in progress starts nothing
+	stats   map[string]*folderStats   // kept across restarts of a folder
+	control map[string]*folderControl // kept across restarts of a folder
+	wg      sync.WaitGroup
+}
+
+// newFolderManager creates a manager with no folders running
+func newFolderManager() *folderManager {
+	return &folderManager{
+		folders: make(map[string]*folderRunner),
+		stats:   make(map[string]*folderStats),
+		control: make(map[string]*folderControl),
+	}
+}
+
+// start starts the pipeline of a folder; the lock must be held
+func (m *folderManager) start(name string, cfg *FolderCfg) {
+	fmt.Printf("[folders.%s]\n%s\n", name, cfg.String())
+	kubismus.Note("folders."+name, cfg.String())
+	kubismus.Define(name+"_Errors", kubismus.COUNT, name+": Errors")
+	kubismus.Define(name+"_Sent", kubismus.COUNT, name+": HTTP Posts")
+	kubismus.Define(name+"_Sent", kubismus.SUM, name+": Bytes Sent")
+	kubismus.Define(name+"_Received", kubismus.SUM, name+": Bytes Received")
+	kubismus.Define(name+"_Encoded", kubismus.SUM, name+": Compressed Bytes Sent")
+	kubismus.Define(name+"_ResponseTime", kubismus.AVERAGE, name+": Average Time (s)")
+	kubismus.Define(name+"_Backlog", kubismus.AVERAGE, name+": Backlog (files)")
+	kubismus.Define(name+"_Retries", kubismus.COUNT, name+": Retries Scheduled")
+	kubismus.Define(name+"_BreakerOpen", kubismus.COUNT, name+": Circuit Breaker Trips")
+
+	st, ok := m.stats[name]
+	if !ok {
+		st = new(folderStats)
+		m.stats[name] = st
+	}
+	cfg.stats = st
+	ctl, ok := m.control[name]
+	if !ok {
+		ctl = newFolderControl()
+		m.control[name] = ctl
+	}
+	cfg.control = ctl
+	cfg.inflight = newInFlight()
+	cfg.retries = newRetryState(name, cfg)
+	cfg.uploads = newUploadState(name, cfg)
+	cfg.breaker = newBreaker(name, cfg)
+	cfg.journal = openJournal(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	postCtx, abort := context.WithCancel(context.Background())
+	r := &folderRunner{name: name, cfg: cfg, cancel: cancel, abort: abort, done: make(chan struct{})}
+	m.folders[name] = r
+
+	ch := readDir(ctx, name, cfg)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(r.done)
+		doHTTP(ctx, postCtx, name, cfg, ch)
+	}()
+}
+
+// Start starts the pipelines of the given folders
+func (m *folderManager) Start(cfg map[string]*FolderCfg) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range sortedNames(cfg) {
+		m.start(name, cfg[name])
+	}
+}
+
+// Reload reads the folder configuration again, starting new folders,
+// stopping removed ones and restarting changed ones. Folders keep running
+// as they are if the configuration cannot be loaded.
+func (m *folderManager) Reload(fn string, drain time.Duration) error {
+	cfg, err := loadFolders(fn, &defaultCfg)
+	if err != nil {
+		return err
+	}
+	if len(cfg) == 0 {
+		return errors.New("No folders configured to watch")
+	}
+
+	m.reload.Lock()
+	defer m.reload.Unlock()
+	m.mu.Lock()
+
+	// stop folders that were removed or changed
+	var stopping []*folderRunner
+	for name, r := range m.folders {
+		newCfg, ok := cfg[name]
+		if !ok {
+			log.Print(name, ": removed from the configuration, stopping")
+		} else if newCfg.encode() != r.cfg.encode() {
+			log.Print(name, ": configuration changed, restarting")
+		} else {
+			// unchanged
+			delete(cfg, name)
+			continue
+		}
+		stopping = append(stopping, r)
+		delete(m.folders, name)
+	}
+
+	// drain without the lock so that the status and metrics pages keep working
+	m.mu.Unlock()
+	var wg sync.WaitGroup
+	wg.Add(len(stopping))
+	for _, r := range stopping {
+		go func(r *folderRunner) {
+			defer wg.Done()
+			r.stop(drain)
+		}(r)
+	}
+	wg.Wait()
+
+	// start new and changed folders
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return nil
+	}
+	for _, name := range sortedNames(cfg) {
+		log.Print(name, ": starting")
+		m.start(name, cfg[name])
+	}
+	return nil
+}
+
+// StopAll stops all of the folders, giving posts in progress time to finish
+func (m *folderManager) StopAll(drain time.Duration) {
+	m.mu.Lock()
+	m.stopped = true
+	runners := make([]*folderRunner, 0, len(m.folders))
+	for _, r := range m.folders {
+		runners = append(runners, r)
+	}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(runners))
+	for _, r := range runners {
+		go func(r *folderRunner) {
+			defer wg.Done()
+			r.stop(drain)
+		}(r)
+	}
+	wg.Wait()
+
+	// folders being restarted by a reload are drained by the reload
+	m.wg.Wait()
+}
+
+// Wait waits for the pipelines of all folders to finish
+func (m *folderManager) Wait() {
+	m.wg.Wait()
+}
+
+// Folders returns the configuration of the running folders
+func (m *folderManager) Folders() map[string]*FolderCfg {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cfg := make(map[string]*FolderCfg, len(m.folders))
+	for name, r := range m.folders {
+		cfg[name] = r.cfg
+	}
+	return cfg
+}
+
+// Folder returns the configuration of a running folder
+func (m *folderManager) Folder(name string) (*FolderCfg, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.folders[name]
+	if !ok {
+		return nil, false
+	}
+	return r.cfg, true
+}
+
+// sortedNames returns the folder names in order
+func sortedNames(cfg map[string]*FolderCfg) []string {
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
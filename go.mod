@@ -6,6 +6,7 @@ require (
 	github.com/ancientlore/kubismus v1.1.3
 	github.com/facebookgo/flagenv v0.0.0-20160425205200-fcd59fca7456
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
 )
 
 require (
@@ -15,4 +16,4 @@ require (
 	github.com/facebookgo/subset v0.0.0-20200203212716-c811ad88dec4 // indirect
 )
 
-go 1.19
+go 1.22
@@ -18,24 +18,36 @@ import (
 	"github.com/google/uuid"
 )
 
-func doHTTP(ctx context.Context, name string, cfg *FolderCfg, ch <-chan os.FileInfo) {
+// doHTTP posts the files from the channel until it is closed or ctx is done.
+// Posts in progress are only canceled when postCtx is done.
+func doHTTP(ctx, postCtx context.Context, name string, cfg *FolderCfg, ch <-chan os.FileInfo) {
 	var wg sync.WaitGroup
 
 	// create HTTP transport and client
-	cfg.transport = &http.Transport{DisableKeepAlives: cfg.NoKeepAlive, MaxIdleConnsPerHost: cfg.Conns, DisableCompression: cfg.NoCompress, ResponseHeaderTimeout: time.Duration(cfg.Timeout)}
-	cfg.client = &http.Client{Transport: cfg.transport, Timeout: time.Duration(cfg.Timeout)}
+	setupClient(cfg)
 
 	// create HTTP posting threads
 	wg.Add(cfg.Conns)
 	for i := 0; i < cfg.Conns; i++ {
-		go posterThread(ctx, name, cfg, ch, &wg)
+		if cfg.BatchFiles > 1 {
+			go batchThread(ctx, postCtx, name, cfg, ch, &wg)
+		} else {
+			go posterThread(ctx, postCtx, name, cfg, ch, &wg)
+		}
 	}
 
 	// Wait for threads to finish
 	wg.Wait()
 }
 
-func posterThread(ctx context.Context, name string, cfg *FolderCfg, ch <-chan os.FileInfo, wg *sync.WaitGroup) {
+// setupClient creates the HTTP transport and client for a folder
+func setupClient(cfg *FolderCfg) {
+	cfg.transport = &http.Transport{DisableKeepAlives: cfg.NoKeepAlive, MaxIdleConnsPerHost: cfg.Conns, DisableCompression: cfg.NoCompress, ResponseHeaderTimeout: time.Duration(cfg.Timeout), TLSClientConfig: cfg.tlsConfig,
+		Proxy: cfg.proxy, OnProxyConnectResponse: checkProxyConnect}
+	cfg.client = &http.Client{Transport: cfg.transport, Timeout: time.Duration(cfg.Timeout)}
+}
+
+func posterThread(ctx, postCtx context.Context, name string, cfg *FolderCfg, ch <-chan os.FileInfo, wg *sync.WaitGroup) {
 	done := ctx.Done()
 	defer wg.Done()
 
@@ -45,8 +57,14 @@ func posterThread(ctx context.Context, name string, cfg *FolderCfg, ch <-chan os
 			if !ok {
 				return
 			}
+			// select picks at random, so the file may have come after ctx was done
+			if ctx.Err() != nil {
+				cfg.inflight.Release(inf.Name())
+				return
+			}
 			//log.Print(name, ": ", inf.Name())
-			processFile(name, cfg, inf)
+			processFile(postCtx, name, cfg, inf)
+			cfg.inflight.Release(inf.Name())
 		case <-done:
 			return
 		}
@@ -54,80 +72,194 @@ func posterThread(ctx context.Context, name string, cfg *FolderCfg, ch <-chan os
 }
 
 type postError struct {
-	err error
+	err        error
+	action     outcome       // what to do with the file
+	retryAfter time.Duration // delay requested by the server
+	status     int           // HTTP status code, if there was a response
+	response   string        // start of the response body, if there was a response
+	url        string        // URL of the failed post
+	delivered  []string      // URLs that have the file when posting to all of them
 }
 
+// maxResponseKept is the number of bytes of a failed response that are kept for reporting
+const maxResponseKept = 4096
+
 func (e postError) Error() string {
 	return e.err.Error()
 }
 
-func processFile(name string, cfg *FolderCfg, inf os.FileInfo) {
-	// unlikely
-	if inf.Name() == "" {
-		log.Printf("%s: File not named", name)
+func processFile(ctx context.Context, name string, cfg *FolderCfg, inf os.FileInfo) {
+	fname, release, ok := claimFile(name, cfg, inf)
+	if !ok {
 		return
 	}
+	defer release()
 
-	// Give very new files a chance to finish up. Sort of hacky.
-	if inf.ModTime().After(time.Now().Add(-time.Second)) {
-		time.Sleep(time.Second)
+	// skip large file, possibly moving it
+	if quarantineOversized(name, cfg, fname, inf) {
+		return
+	}
+
+	// record the attempt in the journal once the file is dealt with
+	rec := newAuditRecord(name, cfg, inf)
+	rec.Attempt = cfg.retries.Attempts(inf.Name()) + 1
+	defer cfg.journal.Write(rec)
+
+	err := postFile(ctx, name, cfg, fname, inf, rec)
+	finishFile(ctx, name, cfg, fname, inf, err, rec)
+}
+
+// claimFile returns the path of a file to post, claiming it by renaming it if
+// desired. The release function puts a claimed file back if it is still there.
+func claimFile(name string, cfg *FolderCfg, inf os.FileInfo) (string, func(), bool) {
+	// unlikely
+	if inf.Name() == "" {
+		log.Printf("%s: File not named", name)
+		return "", nil, false
 	}
 
 	fname := filepath.Join(cfg.Folder, inf.Name())
+	if !cfg.Claim {
+		// the folder listing may be older than the move of a file posted meanwhile
+		if _, err := os.Lstat(fname); os.IsNotExist(err) {
+			return "", nil, false
+		}
+		return fname, func() {}, true
+	}
 
-	// skip large file, possibly moving it
-	if cfg.MaxFileSize > 0 && inf.Size() > cfg.MaxFileSize {
-		//log.Print(name, ":  ", inf.Size(), " byte file, skip/rename: ", fname)
-		if cfg.MoveFailedTo != "" {
-			_, fn := filepath.Split(inf.Name())
-			newFname := filepath.Join(cfg.MoveFailedTo, fn)
-			//log.Printf("%s to %s\n", f, newFname)
-			err := os.Rename(fname, newFname)
+	orig, claimed := fname, fname+claimSuffix
+	err := os.Rename(orig, claimed)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(name, ": failed to claim file ", orig, ": ", err)
+		}
+		return "", nil, false
+	}
+	release := func() {
+		if _, err := os.Lstat(claimed); err == nil {
+			err = os.Rename(claimed, orig)
 			if err != nil {
-				log.Print(name, ": failed to move oversized file ", fname, " to ", newFname, ": ", err)
+				log.Print(name, ": failed to release claimed file ", claimed, ": ", err)
 			}
 		}
-		return
 	}
+	return claimed, release, true
+}
 
-	err := postFile(name, cfg, inf)
+// quarantineOversized returns whether a file is too large to post, moving it
+// to movefailedto if that is set. Files uploaded in chunks have no maximum.
+func quarantineOversized(name string, cfg *FolderCfg, fname string, inf os.FileInfo) bool {
+	if cfg.MaxFileSize <= 0 || inf.Size() <= cfg.MaxFileSize || chunked(cfg, inf) {
+		return false
+	}
+	//log.Print(name, ":  ", inf.Size(), " byte file, skip/rename: ", fname)
+	if cfg.MoveFailedTo != "" {
+		_, fn := filepath.Split(inf.Name())
+		newFname := filepath.Join(cfg.MoveFailedTo, fn)
+		//log.Printf("%s to %s\n", f, newFname)
+		err := os.Rename(fname, newFname)
+		if err != nil {
+			log.Print(name, ": failed to move oversized file ", fname, " to ", newFname, ": ", err)
+		} else {
+			cfg.stats.Moved.Add(1)
+			removeMarker(name, cfg, inf)
+			moveMeta(name, cfg, cfg.Folder, inf.Name(), cfg.MoveFailedTo)
+			writeFailureInfo(name, cfg, inf, newFname, failureInfo{
+				Reason: "oversized",
+				Error:  fmt.Sprint("file size ", inf.Size(), " exceeds maximum of ", cfg.MaxFileSize),
+			})
+		}
+	}
+	return true
+}
+
+// finishFile deletes or moves a file after an attempt to post it, or records
+// the failure for a retry
+func finishFile(ctx context.Context, name string, cfg *FolderCfg, fname string, inf os.FileInfo, err error, rec *auditRecord) {
 	if err == nil {
+		cfg.stats.Posted.Add(1)
+		cfg.retries.Done(inf.Name())
+		cfg.uploads.Done(inf.Name())
 		if cfg.MoveTo == "" {
+			rec.Disposition = DispDeleted
 			err = os.Remove(fname)
 			if err != nil {
 				log.Print(name, ": failed to remove file ", fname, ": ", err)
+				rec.Disposition, rec.Error = DispPosted, err.Error()
+			} else {
+				removeMarker(name, cfg, inf)
+				moveMeta(name, cfg, cfg.Folder, inf.Name(), "")
 			}
 		} else {
+			rec.Disposition = DispMoved
 			_, fn := filepath.Split(inf.Name())
 			newFname := filepath.Join(cfg.MoveTo, fn)
 			//log.Printf("%s to %s\n", f, newFname)
 			err := os.Rename(fname, newFname)
 			if err != nil {
 				log.Print(name, ": failed to move file ", fname, " to ", newFname, ": ", err)
+				rec.Disposition, rec.Error = DispPosted, err.Error()
+			} else {
+				removeMarker(name, cfg, inf)
+				moveMeta(name, cfg, cfg.Folder, inf.Name(), cfg.MoveTo)
 			}
 		}
 	} else {
-		switch err.(type) {
+		rec.Error = err.Error()
+		// a post canceled during shutdown is neither a failure nor a retry
+		if ctx.Err() != nil {
+			log.Print(name, ": abandoned ", inf.Name(), " during shutdown")
+			rec.Disposition = DispAbandoned
+			return
+		}
+		cfg.stats.Failed.Add(1)
+		rec.Disposition = DispRetry
+		switch pe := err.(type) {
 		case postError:
-			if cfg.MoveFailedTo != "" {
+			if pe.action == OutcomeLeave {
+				log.Print(name, ": leaving ", inf.Name(), " in place")
+				cfg.retries.Leave(inf.Name(), err)
+				rec.Disposition = DispLeft
+				return
+			}
+			retry := cfg.retries.Failed(inf.Name(), err)
+			if cfg.MoveFailedTo == "" || (pe.action == OutcomeRetry && retry.Attempts < cfg.Attempts) {
+				kubismus.Metric(name+"_Retries", 1, 0)
+			} else {
+				cfg.retries.Done(inf.Name())
+				cfg.uploads.Done(inf.Name())
 				_, fn := filepath.Split(inf.Name())
 				newFname := filepath.Join(cfg.MoveFailedTo, fn)
 				//log.Printf("%s to %s\n", f, newFname)
 				err := os.Rename(fname, newFname)
 				if err != nil {
 					log.Print(name, ": failed to move failed file ", fname, " to ", newFname, ": ", err)
+				} else {
+					rec.Disposition = DispFailed
+					cfg.stats.Moved.Add(1)
+					removeMarker(name, cfg, inf)
+					moveMeta(name, cfg, cfg.Folder, inf.Name(), cfg.MoveFailedTo)
+					writeFailureInfo(name, cfg, inf, newFname, failureInfo{
+						URL:          pe.url,
+						Reason:       pe.action.String(),
+						Status:       pe.status,
+						Error:        pe.Error(),
+						Response:     pe.response,
+						Attempts:     retry.Attempts,
+						FirstFailure: &retry.First,
+						LastFailure:  &retry.Last,
+					})
 				}
 			}
 		}
 	}
 }
 
-func postFile(name string, cfg *FolderCfg, inf os.FileInfo) error {
+// postTarget posts a file to one URL, filling in the details of the attempt in rec
+func postTarget(ctx context.Context, name string, cfg *FolderCfg, url string, spec *requestSpec, fname string, inf os.FileInfo, rec *auditRecord) error {
 	var f io.ReadCloser
 	var err error
 
-	fname := filepath.Join(cfg.Folder, inf.Name())
-
 	// open file
 	f, err = os.Open(fname)
 	if err != nil {
@@ -136,39 +268,129 @@ func postFile(name string, cfg *FolderCfg, inf os.FileInfo) error {
 	}
 	// defer f.Close()
 
+	// hash the body for the journal
+	var body io.Reader = f
+	var hr *hashReader
+	if cfg.journal != nil {
+		hr = newHashReader(f)
+		body = hr
+	}
+
+	// find the content type if possible
+	ct := spec.contentType
+	if ct == "" {
+		ct = mime.TypeByExtension(filepath.Ext(inf.Name()))
+	}
+
+	// wrap the file in a form upload if desired
+	size := inf.Size()
+	if cfg.Body == BodyMultipart {
+		body, size, ct, err = multipartBody(spec, body, size, ct)
+		if err != nil {
+			f.Close()
+			return postError{err: err, action: OutcomeFail, url: url}
+		}
+	}
+
+	// compress the body if desired, which makes its length unknown
+	var stop func() int64
+	if encoded(cfg, inf) {
+		body, stop = compressBody(body, cfg.Encode)
+		size = -1
+	}
+
 	// create request
-	req, err := http.NewRequest(cfg.Method, cfg.URL, f)
+	rec.URL = url
+	rec.Method = spec.method
+	req, err := http.NewRequestWithContext(ctx, spec.method, url, body)
 	if err != nil {
 		f.Close()
 		log.Fatal(err)
 	}
 
 	// set content type if possible
-	ct := mime.TypeByExtension(filepath.Ext(fname))
 	if ct != "" {
 		req.Header.Set("Content-Type", ct)
 	}
 
 	// set content length
-	req.ContentLength = inf.Size()
+	req.ContentLength = size
+	if stop != nil {
+		req.Header.Set("Content-Encoding", cfg.Encode)
+	}
+
+	setFileInfo(req, cfg, inf)
+	if err = setHeaders(req, cfg, spec, rec); err != nil {
+		if stop != nil {
+			stop()
+		}
+		f.Close()
+		return err
+	}
+
+	// log.Printf("%#v", req)
+	t := time.Now()
+	resp, err := cfg.client.Do(req)
+	var n int64
+	if stop != nil {
+		n = stop()
+	}
+	f.Close()
+	if hr != nil {
+		rec.SHA256 = hr.Sum(inf.Size())
+	}
+	rec.Latency = time.Since(t).Seconds()
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		kubismus.Metric(name+"_Errors", 1, 0)
+		log.Print(name, ": HTTP error ", url, ": ", err)
+		return postError{err: err, action: errorOutcome(cfg.Outcomes, err), url: url}
+	}
+	kubismus.Metric(name+"_Sent", 1, float64(inf.Size()))
+	cfg.stats.Sent.Add(inf.Size())
+	if stop != nil {
+		recordEncoded(name, cfg, inf.Size(), n)
+	}
+
+	return checkResponse(name, cfg, url, resp, t, rec)
+}
+
+// recordEncoded counts the bytes of a compressed post before and after compression
+func recordEncoded(name string, cfg *FolderCfg, raw, encoded int64) {
+	kubismus.Metric(name+"_Encoded", 1, float64(encoded))
+	cfg.stats.Raw.Add(raw)
+	cfg.stats.Encoded.Add(encoded)
+}
+
+// setFileInfo sets the file info headers if desired
+func setFileInfo(req *http.Request, cfg *FolderCfg, inf os.FileInfo) {
+	if cfg.FileInfo {
+		req.Header.Set("X-Autohurl-Name", inf.Name())
+		req.Header.Set("X-Autohurl-Size", fmt.Sprintf("%d", inf.Size()))
+		req.Header.Set("X-Autohurl-Modtime", inf.ModTime().Format(time.RFC3339Nano))
+	}
+}
 
+// setHeaders sets the request ID, credentials and configured headers of a request
+func setHeaders(req *http.Request, cfg *FolderCfg, spec *requestSpec, rec *auditRecord) error {
 	// Set request ID header if desired
 	if cfg.UseRequestID != "" {
 		guid, err := uuid.NewRandom()
 		if err == nil {
 			req.Header.Set(cfg.UseRequestID, guid.String())
+			rec.RequestID = guid.String()
 		}
 	}
 
-	// set file info headers
-	if cfg.FileInfo {
-		req.Header.Set("X-Autohurl-Name", inf.Name())
-		req.Header.Set("X-Autohurl-Size", fmt.Sprintf("%d", inf.Size()))
-		req.Header.Set("X-Autohurl-Modtime", inf.ModTime().Format(time.RFC3339Nano))
+	// set credentials, which configured headers may override
+	if err := setAuth(req, cfg); err != nil {
+		return err
 	}
 
 	// set headers
-	for _, h := range cfg.Headers {
+	for _, h := range spec.headers {
 		if h.Mode == HdrSet {
 			req.Header.Set(h.Key, h.Value)
 		} else {
@@ -176,31 +398,46 @@ func postFile(name string, cfg *FolderCfg, inf os.FileInfo) error {
 		}
 	}
 	req.Close = false
+	return nil
+}
 
-	// log.Printf("%#v", req)
-	t := time.Now()
-	resp, err := cfg.client.Do(req)
-	f.Close()
-	if err != nil {
-		kubismus.Metric(name+"_Errors", 1, 0)
-		log.Print(name, ": HTTP error ", cfg.URL, ": ", err)
-		return postError{err: err}
-	}
-	kubismus.Metric(name+"_Sent", 1, float64(inf.Size()))
-
-	if resp.ContentLength > 0 {
-		sz, err := io.Copy(ioutil.Discard, resp.Body)
+// checkResponse reads the response to a post and decides whether it succeeded
+func checkResponse(name string, cfg *FolderCfg, url string, resp *http.Response, t time.Time, rec *auditRecord) error {
+	var err error
+	var head []byte
+	if resp.ContentLength != 0 {
+		// keep the start of the body in case the post failed
+		head, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseKept))
 		if err == nil {
-			kubismus.Metric(name+"_Received", 1, float64(sz))
-		} else {
-			// ignoring it because HTTP code was a success
+			var sz int64
+			sz, err = io.Copy(ioutil.Discard, resp.Body)
+			sz += int64(len(head))
+			if err == nil {
+				kubismus.Metric(name+"_Received", 1, float64(sz))
+				cfg.stats.Received.Add(sz)
+			}
 		}
+		// errors reading the body are ignored - the status code decides the outcome
 	}
 	resp.Body.Close()
-	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+	rec.Status = resp.StatusCode
+	rec.Latency = time.Since(t).Seconds()
+	cfg.stats.Response(resp.StatusCode, time.Since(t))
+	action := statusOutcome(cfg.Outcomes, resp.StatusCode)
+	if action != OutcomeSuccess {
 		kubismus.Metric(name+"_Errors", 1, 0)
-		log.Print(name, ": Failed to post to ", cfg.URL, ", status ", resp.Status)
-		return postError{err: errors.New(fmt.Sprint(name, ": Failed to post to ", cfg.URL, ", status ", resp.Status))}
+		log.Print(name, ": Failed to post to ", url, ", status ", resp.Status)
+		pe := postError{
+			err:      errors.New(fmt.Sprint(name, ": Failed to post to ", url, ", status ", resp.Status)),
+			action:   action,
+			status:   resp.StatusCode,
+			response: string(head),
+			url:      url,
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			pe.retryAfter = retryAfter(resp)
+		}
+		return pe
 	}
 	d := time.Since(t)
 	kubismus.Metric(name+"_ResponseTime", 1, float64(d.Nanoseconds())/float64(time.Second))
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// claimSuffix is appended to files that a poster has claimed by renaming them
+const claimSuffix = ".autohurl-processing"
+
+// inFlight tracks the files of a folder that have been dispatched to a poster
+// and are not finished yet, so that they are not dispatched a second time
+type inFlight struct {
+	mu    sync.Mutex
+	files map[string]time.Time
+}
+
+// newInFlight creates an empty in-flight registry
+func newInFlight() *inFlight {
+	return &inFlight{files: make(map[string]time.Time)}
+}
+
+// Claim marks a file as in flight, returning false if it already is
+func (f *inFlight) Claim(fn string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.files[fn]; ok {
+		return false
+	}
+	f.files[fn] = time.Now()
+	return true
+}
+
+// Release marks a file as no longer in flight
+func (f *inFlight) Release(fn string) {
+	f.mu.Lock()
+	delete(f.files, fn)
+	f.mu.Unlock()
+}
+
+// Len returns the number of files in flight
+func (f *inFlight) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.files)
+}
+
+// isClaimed returns whether the file name is one that a poster renamed to claim it
+func isClaimed(fn string) bool {
+	return strings.HasSuffix(fn, claimSuffix)
+}
+
+// recoverClaims renames files left claimed by a previous run back to their
+// original names so that they are posted again
+func recoverClaims(name string, cfg *FolderCfg) {
+	entries, err := os.ReadDir(cfg.Folder)
+	if err != nil {
+		log.Print(name, ": Unable to look for claimed files: ", err)
+		return
+	}
+	for _, ent := range entries {
+		if !ent.Type().IsRegular() || !isClaimed(ent.Name()) {
+			continue
+		}
+		claimed := filepath.Join(cfg.Folder, ent.Name())
+		orig := strings.TrimSuffix(claimed, claimSuffix)
+		if _, err := os.Lstat(orig); err == nil {
+			log.Print(name, ": Not recovering ", claimed, ", ", orig, " already exists")
+			continue
+		}
+		err = os.Rename(claimed, orig)
+		if err != nil {
+			log.Print(name, ": failed to recover claimed file ", claimed, ": ", err)
+		} else {
+			log.Print(name, ": Recovered ", orig, " from an interrupted post")
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dispositions of a file after a post attempt
+const (
+	DispDeleted   = "deleted"   // posted and removed
+	DispMoved     = "moved"     // posted and moved to moveto
+	DispPosted    = "posted"    // posted, but could not be removed or moved
+	DispFailed    = "failed"    // moved to movefailedto
+	DispRetry     = "retry"     // left in the folder to be retried
+	DispLeft      = "left"      // left in the folder and not retried
+	DispKept      = "kept"      // replayed file left where it was
+	DispAbandoned = "abandoned" // post canceled during shutdown
+)
+
+// auditRecord is the journal entry of one post attempt
+type auditRecord struct {
+	Time        time.Time `json:"time"`                // when the attempt finished
+	Folder      string    `json:"folder"`              // name of the folder configuration
+	File        string    `json:"file"`                // name of the file
+	Size        int64     `json:"size"`                // size of the file
+	SHA256      string    `json:"sha256,omitempty"`    // hash of the bytes sent, if all were sent
+	URL         string    `json:"url"`                 // URL posted to, or the last one tried
+	Delivered   []string  `json:"delivered,omitempty"` // URLs that have the file when posting to all of them
+	Method      string    `json:"method"`              // HTTP method used
+	RequestID   string    `json:"requestId,omitempty"` // value of the request ID header
+	Status      int       `json:"status,omitempty"`    // HTTP status code, if there was a response
+	Latency     float64   `json:"latency"`             // seconds until the response was read
+	Attempt     int       `json:"attempt"`             // attempt number, starting at 1
+	Disposition string    `json:"disposition"`         // what happened to the file
+	Error       string    `json:"error,omitempty"`     // why the attempt failed
+}
+
+// newAuditRecord starts the journal entry of an attempt to post a file
+func newAuditRecord(name string, cfg *FolderCfg, inf os.FileInfo) *auditRecord {
+	return &auditRecord{
+		Folder: name,
+		File:   inf.Name(),
+		Size:   inf.Size(),
+		Method: cfg.Method,
+	}
+}
+
+// journal appends audit records to a JSON lines file, rotating it by size
+type journal struct {
+	mu   sync.Mutex
+	path string
+	size int64 // size at which the file is rotated
+	keep int   // number of rotated files to keep
+	f    *os.File
+	n    int64 // current size of the file
+}
+
+// journals are the open journals by path, shared by folders using the same file
+var journals = struct {
+	sync.Mutex
+	m map[string]*journal
+}{m: make(map[string]*journal)}
+
+// openJournal returns the journal of a folder, or nil if it has none. The file
+// is opened when the first record is written.
+func openJournal(cfg *FolderCfg) *journal {
+	if cfg.Journal == "" {
+		return nil
+	}
+	path, err := filepath.Abs(cfg.Journal)
+	if err != nil {
+		path = cfg.Journal
+	}
+	journals.Lock()
+	defer journals.Unlock()
+	j, ok := journals.m[path]
+	if !ok {
+		j = &journal{path: path, size: cfg.JournalSize, keep: cfg.JournalKeep}
+		journals.m[path] = j
+	}
+	return j
+}
+
+// Write appends a record to the journal; a nil journal ignores it
+func (j *journal) Write(rec *auditRecord) {
+	if j == nil {
+		return
+	}
+	rec.Time = time.Now()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Print(rec.Folder, ": Unable to encode journal record: ", err)
+		return
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil && !j.open(rec.Folder) {
+		return
+	}
+	if j.size > 0 && j.n > 0 && j.n+int64(len(data)) > j.size {
+		j.rotate()
+		if !j.open(rec.Folder) {
+			return
+		}
+	}
+	n, err := j.f.Write(data)
+	j.n += int64(n)
+	if err != nil {
+		log.Print(rec.Folder, ": Unable to write journal: ", err)
+	}
+}
+
+// open opens the file for appending; the lock must be held
+func (j *journal) open(name string) bool {
+	var err error
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Print(name, ": Unable to open journal: ", err)
+		return false
+	}
+	j.n = 0
+	if fi, err := j.f.Stat(); err == nil {
+		j.n = fi.Size()
+	}
+	return true
+}
+
+// rotate closes the file and shifts it into the rotated files; the lock must be held
+func (j *journal) rotate() {
+	j.f.Close()
+	j.f = nil
+	if j.keep <= 0 {
+		if err := os.Remove(j.path); err != nil {
+			log.Print("Unable to remove journal: ", err)
+		}
+		return
+	}
+	os.Remove(fmt.Sprint(j.path, ".", j.keep))
+	for i := j.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprint(j.path, ".", i), fmt.Sprint(j.path, ".", i+1))
+	}
+	if err := os.Rename(j.path, j.path+".1"); err != nil {
+		log.Print("Unable to rotate journal: ", err)
+	}
+}
+
+// hashReader hashes the bytes read through it
+type hashReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+// newHashReader creates a reader that computes the SHA-256 of what is read
+func newHashReader(r io.Reader) *hashReader {
+	return &hashReader{r: r, h: sha256.New()}
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+// Sum returns the hash if exactly size bytes were read
+func (h *hashReader) Sum(size int64) string {
+	if h.n != size {
+		return ""
+	}
+	return hex.EncodeToString(h.h.Sum(nil))
+}
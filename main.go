@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"syscall"
 	"time"
 
 	"github.com/ancientlore/flagcfg"
@@ -19,13 +20,15 @@ import (
 )
 
 var (
-	addr       string
-	cpuProfile string
-	memProfile string
-	cpus       int
-	workingDir string
-	version    bool
-	help       bool
+	addr         string
+	cpuProfile   string
+	memProfile   string
+	cpus         int
+	workingDir   string
+	version      bool
+	help         bool
+	once         bool
+	drainTimeout = 30 * time.Second
 
 	defaultCfg DefaultCfg
 
@@ -54,7 +57,62 @@ func init() {
 	// processing
 	flag.DurationVar((*time.Duration)(&defaultCfg.SleepTime), "sleep", time.Duration(defaultCfg.SleepTime), "Interval to wait when no files are found.")
 	flag.Int64Var(&defaultCfg.MaxFileSize, "maxsize", defaultCfg.MaxFileSize, "Maximum file size to post.")
-	flag.IntVar(&defaultCfg.BatchSize, "batchsize", defaultCfg.BatchSize, "Readdir batch size.")
+	flag.IntVar(&defaultCfg.BatchSize, "batchsize", defaultCfg.BatchSize, "Number of directory entries to read per batch.")
+	flag.StringVar(&defaultCfg.Watch, "watch", defaultCfg.Watch, "Folder watch mode: poll or inotify.")
+	flag.DurationVar((*time.Duration)(&defaultCfg.Rescan), "rescan", time.Duration(defaultCfg.Rescan), "Interval for full rescans when watching with inotify.")
+	flag.BoolVar(&defaultCfg.Claim, "claim", defaultCfg.Claim, "Rename files while posting them so interrupted posts are recovered on restart.")
+
+	// file readiness
+	flag.DurationVar((*time.Duration)(&defaultCfg.MinAge), "minage", time.Duration(defaultCfg.MinAge), "Minimum time since a file was last modified before posting it.")
+	flag.IntVar(&defaultCfg.StableScans, "stablescans", defaultCfg.StableScans, "Number of scans a file's size and modification time must be unchanged before posting it.")
+	flag.StringVar(&defaultCfg.ReadyMarker, "readymarker", defaultCfg.ReadyMarker, "Suffix of a companion file that must exist before posting a file, like .ready.")
+	flag.StringVar(&defaultCfg.Ignore, "ignore", defaultCfg.Ignore, "Comma-separated patterns of temporary files to ignore, like *.tmp,*.part.")
+	flag.BoolVar(&defaultCfg.Flock, "flock", defaultCfg.Flock, "Skip files that the writer holds an advisory lock on.")
+
+	// retries
+	flag.IntVar(&defaultCfg.Attempts, "attempts", defaultCfg.Attempts, "Number of attempts to post a file before moving it to movefailedto.")
+	flag.DurationVar((*time.Duration)(&defaultCfg.Backoff), "backoff", time.Duration(defaultCfg.Backoff), "Delay before retrying a failed file, doubled on each attempt.")
+	flag.DurationVar((*time.Duration)(&defaultCfg.MaxBackoff), "maxbackoff", time.Duration(defaultCfg.MaxBackoff), "Maximum delay before retrying a failed file.")
+	flag.Float64Var(&defaultCfg.Jitter, "jitter", defaultCfg.Jitter, "Fraction by which retry delays are randomly varied.")
+	flag.StringVar(&defaultCfg.StateDir, "statedir", defaultCfg.StateDir, "Folder for state kept across restarts (default is .autohurl in each folder).")
+	flag.IntVar(&defaultCfg.Breaker, "breaker", defaultCfg.Breaker, "Number of consecutive failures that pause a folder (negative disables).")
+	flag.DurationVar((*time.Duration)(&defaultCfg.Cooldown), "cooldown", time.Duration(defaultCfg.Cooldown), "Time to pause a folder before probing its endpoint again.")
+	flag.BoolVar(&defaultCfg.ErrorInfo, "errorinfo", defaultCfg.ErrorInfo, "Write a .error.json file with the failure reason next to each file moved to movefailedto.")
+	flag.StringVar(&defaultCfg.Journal, "journal", defaultCfg.Journal, "JSON lines file recording every post attempt.")
+	flag.Int64Var(&defaultCfg.JournalSize, "journalsize", defaultCfg.JournalSize, "Size in bytes at which the journal is rotated.")
+	flag.IntVar(&defaultCfg.JournalKeep, "journalkeep", defaultCfg.JournalKeep, "Number of rotated journals to keep.")
+	flag.StringVar(&defaultCfg.URLMode, "urlmode", defaultCfg.URLMode, "How files are posted to a folder's URLs: all, failover or roundrobin.")
+	flag.IntVar(&defaultCfg.Quorum, "quorum", defaultCfg.Quorum, "Number of URLs that must accept a file in all mode (0 means all of them).")
+	flag.StringVar(&defaultCfg.Body, "body", defaultCfg.Body, "How files are sent: raw as the request body, or multipart as a form upload.")
+	flag.StringVar(&defaultCfg.FieldName, "fieldname", defaultCfg.FieldName, "Form field of the file in multipart mode.")
+	flag.StringVar(&defaultCfg.FileName, "filename", defaultCfg.FileName, "File name sent in multipart mode; a template like the URLs.")
+	flag.StringVar(&defaultCfg.FieldText, "fields", defaultCfg.FieldText, "Extra form fields in multipart mode (name: value), delimited by -hdrdelim.")
+	flag.IntVar(&defaultCfg.BatchFiles, "batchfiles", defaultCfg.BatchFiles, "Maximum number of files posted in one request (0 or 1 disables batching).")
+	flag.Int64Var(&defaultCfg.BatchBytes, "batchbytes", defaultCfg.BatchBytes, "Maximum size of the files posted in one request (0 means no limit).")
+	flag.DurationVar((*time.Duration)(&defaultCfg.BatchWait), "batchwait", time.Duration(defaultCfg.BatchWait), "Time to wait for more files before posting a batch.")
+	flag.StringVar(&defaultCfg.BatchFormat, "batchformat", defaultCfg.BatchFormat, "Encoding of a batch: ndjson, json, multipart or tar.")
+	flag.StringVar(&defaultCfg.Upload, "upload", defaultCfg.Upload, "Upload files larger than chunksize in chunks: range or tus.")
+	flag.Int64Var(&defaultCfg.ChunkSize, "chunksize", defaultCfg.ChunkSize, "Size of the chunks of a chunked upload.")
+	flag.StringVar(&defaultCfg.Encode, "encode", defaultCfg.Encode, "Compress request bodies: gzip, zstd or deflate.")
+	flag.StringVar(&defaultCfg.EncodeSkip, "encodeskip", defaultCfg.EncodeSkip, "Comma-separated extensions of files that are not compressed.")
+	flag.StringVar(&defaultCfg.CAFile, "cafile", defaultCfg.CAFile, "PEM bundle of CAs to trust besides the system's.")
+	flag.StringVar(&defaultCfg.CertFile, "certfile", defaultCfg.CertFile, "PEM client certificate, reloaded when it changes.")
+	flag.StringVar(&defaultCfg.KeyFile, "keyfile", defaultCfg.KeyFile, "PEM key of the client certificate.")
+	flag.StringVar(&defaultCfg.TLSMin, "tlsmin", defaultCfg.TLSMin, "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3.")
+	flag.StringVar(&defaultCfg.ServerName, "servername", defaultCfg.ServerName, "Server name to verify instead of the URL's host.")
+	flag.BoolVar(&defaultCfg.Insecure, "insecure", defaultCfg.Insecure, "Skip verifying server certificates (for testing only).")
+	flag.StringVar(&defaultCfg.Proxy, "proxy", defaultCfg.Proxy, "Proxy URL (http, https, socks5 or socks5h), or environment to use HTTP_PROXY, HTTPS_PROXY and NO_PROXY.")
+	flag.StringVar(&defaultCfg.Auth, "auth", defaultCfg.Auth, "Authentication: basic, bearer or oauth2.")
+	flag.StringVar(&defaultCfg.Username, "username", defaultCfg.Username, "User name for basic auth.")
+	flag.StringVar(&defaultCfg.Password, "password", defaultCfg.Password, "Password for basic auth.")
+	flag.StringVar(&defaultCfg.TokenFile, "tokenfile", defaultCfg.TokenFile, "File holding the bearer token, read again when it changes.")
+	flag.StringVar(&defaultCfg.TokenURL, "tokenurl", defaultCfg.TokenURL, "OAuth2 token endpoint for the client credentials grant.")
+	flag.StringVar(&defaultCfg.ClientID, "clientid", defaultCfg.ClientID, "OAuth2 client ID.")
+	flag.StringVar(&defaultCfg.ClientSecret, "clientsecret", defaultCfg.ClientSecret, "OAuth2 client secret.")
+	flag.StringVar(&defaultCfg.Scopes, "scopes", defaultCfg.Scopes, "OAuth2 scopes, separated by commas or spaces.")
+	flag.StringVar(&defaultCfg.MetaSuffix, "metasuffix", defaultCfg.MetaSuffix, "Suffix of a companion file (TOML or JSON) with headers, path, method and content type for a file.")
+	flag.StringVar(&defaultCfg.NamePattern, "namepattern", defaultCfg.NamePattern, "Regular expression whose submatches of the file name are available to URL and header templates.")
+	flag.StringVar(&defaultCfg.OutcomeText, "outcomes", defaultCfg.OutcomeText, "Comma-separated rules mapping status codes and error classes to success, retry, fail or leave, like 404=leave,4xx=fail.")
 
 	// headers
 	flag.StringVar(&defaultCfg.HeaderDelim, "hdrdelim", defaultCfg.HeaderDelim, "Delimiter for HTTP headers specified with -header.")
@@ -67,6 +125,8 @@ func init() {
 	// runtime
 	flag.IntVar(&cpus, "cpu", cpus, "Number of CPUs to use.")
 	flag.StringVar(&workingDir, "wd", workingDir, "Set the working directory.")
+	flag.BoolVar(&once, "once", once, "Post the files found, then exit once the folders are empty.")
+	flag.DurationVar(&drainTimeout, "drain", drainTimeout, "Time to let posts in progress finish when shutting down.")
 
 	// help
 	flag.BoolVar(&version, "version", false, "Show version.")
@@ -84,14 +144,19 @@ func showHelp() {
 A tool to continuously post files found in a folder.
 
 Usage:
-  autohurl [options] url1 [url2 ... urlN]
+  autohurl [options]
+  autohurl [options] replay [replay options] folder
 
 Example:
   autohurl -method POST -files "*.xml" -conns 10
+  autohurl replay -from failed -match "*.xml" -dryrun orders
 
 Options:`)
 	flag.PrintDefaults()
 	fmt.Println(`
+Replay options:`)
+	replayFlags(&replayOptions{}).PrintDefaults()
+	fmt.Println(`
 All of the options can be set via environment variables prefixed with "AUTOHURL_" - for instance,
 AUTOHURL_TIMEOUT can be set to "30s" to increase the default timeout.
 
@@ -104,6 +169,14 @@ func showVersion() {
 }
 
 func main() {
+	// exit with a failure code once everything is cleaned up, if needed
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	// Parse flags from command-line
 	flag.Parse()
 
@@ -131,6 +204,14 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = defaultCfg.ParseOutcomes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = defaultCfg.ParseFields()
+	if err != nil {
+		log.Fatal(err)
+	}
 	// log.Printf("%#v", headers)
 
 	// setup number of CPUs
@@ -168,6 +249,16 @@ func main() {
 		kubismus.Note("Working Directory", wd)
 	}
 
+	// run a command instead of watching folders
+	switch flag.Arg(0) {
+	case "":
+	case "replay":
+		exitCode = replayCommand(flag.Args()[1:])
+		return
+	default:
+		log.Fatal("Unknown command: ", flag.Arg(0))
+	}
+
 	// Print settings
 	fmt.Printf("addr = \"%s\"\n", addr)
 	fmt.Printf("cpu = %d\n", cpus)
@@ -181,28 +272,13 @@ func main() {
 
 	// read folders
 	var cfg map[string]*FolderCfg
-	cfg, err = readConfig(flagcfg.Filename())
+	cfg, err = loadFolders(flagcfg.Filename(), &defaultCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	if len(cfg) == 0 {
 		log.Fatal("No folders configured to watch")
 	}
-	// set up default settings
-	for i := range cfg {
-		cfg[i].SetDefaults(&defaultCfg)
-		err = cfg[i].ParseHeaders()
-		if err != nil {
-			log.Fatal(err)
-		}
-		fmt.Printf("[folders.%s]\n%s\n", i, cfg[i].String())
-		kubismus.Note("folders."+i, cfg[i].String())
-		kubismus.Define(i+"_Errors", kubismus.COUNT, i+": Errors")
-		kubismus.Define(i+"_Sent", kubismus.COUNT, i+": HTTP Posts")
-		kubismus.Define(i+"_Sent", kubismus.SUM, i+": Bytes Sent")
-		kubismus.Define(i+"_Received", kubismus.SUM, i+": Bytes Received")
-		kubismus.Define(i+"_ResponseTime", kubismus.AVERAGE, i+": Average Time (s)")
-	}
 
 	// setup the thread context
 	ctx, cancel := context.WithCancel(context.Background())
@@ -223,25 +299,14 @@ func main() {
 		}
 	}()
 
-	// handle kill signals
-	go func() {
-		// Set up channel on which to send signal notifications.
-		// We must use a buffered channel or risk missing the signal
-		// if we're not ready to receive when the signal is sent.
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, os.Kill)
-
-		// Block until a signal is received.
-		s := <-c
-		log.Print("Got signal ", s, ", canceling work")
-		cancel()
-	}()
+	// Build pipelines
+	start := time.Now()
+	folders := newFolderManager()
+	folders.Start(cfg)
 
-	// Build pipeline
-	for name, fldr := range cfg {
-		ch1 := readDir(ctx, name, fldr)
-		go doHTTP(ctx, name, fldr, ch1)
-	}
+	// admin endpoints
+	handleAdmin(folders)
+	handleMetrics(folders)
 
 	// write memory profile if configured
 	if memProfile != "" {
@@ -258,5 +323,66 @@ func main() {
 	}
 
 	// status web site
-	log.Fatal(http.ListenAndServe(addr, nil))
+	srv := &http.Server{Addr: addr}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			if once {
+				log.Print(err)
+			} else {
+				log.Fatal(err)
+			}
+		}
+	}()
+
+	// wait for a signal, or for the folders to be drained when running once
+	var finished chan struct{}
+	if once {
+		finished = make(chan struct{})
+		go func() {
+			folders.Wait()
+			close(finished)
+		}()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+waitLoop:
+	for {
+		select {
+		case s := <-sigs:
+			if s == syscall.SIGHUP {
+				if once {
+					continue
+				}
+				log.Print("Got signal ", s, ", reloading folders")
+				err = folders.Reload(flagcfg.Filename(), drainTimeout)
+				if err != nil {
+					log.Print("Unable to reload folders: ", err)
+				}
+				continue
+			}
+			log.Print("Got signal ", s, ", finishing posts in progress")
+			break waitLoop
+		case <-finished:
+			break waitLoop
+		}
+	}
+	signal.Stop(sigs)
+
+	// stop dispatching files and give the posters time to finish
+	folders.StopAll(drainTimeout)
+
+	// shut down the status web site
+	sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err = srv.Shutdown(sctx)
+	scancel()
+	if err != nil {
+		log.Print("Unable to shut down status web site: ", err)
+	}
+
+	if once {
+		if printSummary(folders.Folders(), time.Since(start)) > 0 {
+			exitCode = 1
+		}
+	}
 }
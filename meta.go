@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// fileMeta is the sidecar metadata a producer can put next to a file
+type fileMeta struct {
+	Headers     map[string]string `toml:"headers" json:"headers"`         // headers set on top of the folder's headers
+	Path        string            `toml:"path" json:"path"`               // path appended to the URLs
+	Method      string            `toml:"method" json:"method"`           // HTTP method instead of the folder's
+	ContentType string            `toml:"contenttype" json:"contentType"` // content type instead of the one from the extension
+}
+
+// requestSpec is what is sent along with a file besides its contents
+type requestSpec struct {
+	method      string
+	contentType string // overrides the content type from the file extension
+	headers     []hdr
+	fields      []hdr  // form fields in multipart mode
+	fieldName   string // form field of the file in multipart mode
+	fileName    string // file name in multipart mode
+}
+
+// isMeta returns whether a file name is sidecar metadata
+func isMeta(cfg *FolderCfg, fn string) bool {
+	return cfg.MetaSuffix != "" && strings.HasSuffix(fn, cfg.MetaSuffix)
+}
+
+// readMeta reads the sidecar metadata of a file in dir, if there is any. The
+// format is JSON if the file starts with a brace and TOML otherwise.
+func readMeta(cfg *FolderCfg, dir string, inf os.FileInfo) (*fileMeta, error) {
+	if cfg.MetaSuffix == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, inf.Name()+cfg.MetaSuffix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m fileMeta
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = json.Unmarshal(data, &m)
+	} else {
+		_, err = toml.Decode(string(data), &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("metadata %s%s: %w", inf.Name(), cfg.MetaSuffix, err)
+	}
+	return &m, nil
+}
+
+// apply merges the metadata into the URLs and request of a file
+func (m *fileMeta) apply(urls []string, spec *requestSpec) error {
+	if m == nil {
+		return nil
+	}
+	if m.Path != "" {
+		for i := range urls {
+			u, err := url.Parse(urls[i])
+			if err != nil {
+				return err
+			}
+			urls[i] = u.JoinPath(m.Path).String()
+		}
+	}
+	if m.Method != "" {
+		spec.method = strings.ToUpper(m.Method)
+	}
+	if m.ContentType != "" {
+		spec.contentType = m.ContentType
+	}
+	for k, v := range m.Headers {
+		spec.headers = append(spec.headers, hdr{Key: k, Value: v, Mode: HdrSet})
+	}
+	return nil
+}
+
+// moveMeta deletes the sidecar metadata of a file that left the folder src,
+// or moves it to dst if that is set
+func moveMeta(name string, cfg *FolderCfg, src, fn, dst string) {
+	if cfg.MetaSuffix == "" {
+		return
+	}
+	mfn := filepath.Join(src, fn+cfg.MetaSuffix)
+	var err error
+	if dst == "" {
+		err = os.Remove(mfn)
+	} else {
+		err = os.Rename(mfn, filepath.Join(dst, fn+cfg.MetaSuffix))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(name, ": failed to clean up metadata ", mfn, ": ", err)
+	}
+}
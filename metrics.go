@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleMetrics registers the Prometheus metrics endpoint on the status web site
+func handleMetrics(folders *folderManager) {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		b := bufio.NewWriter(w)
+		writeMetrics(b, folders.Folders(), time.Now())
+		b.Flush()
+	})
+}
+
+// writeMetrics writes the metrics of the running folders in the Prometheus text format
+func writeMetrics(w *bufio.Writer, cfg map[string]*FolderCfg, now time.Time) {
+	names := sortedNames(cfg)
+
+	// counters and gauges with one value per folder
+	simple := []struct {
+		name, kind, help string
+		value            func(cfg *FolderCfg) float64
+	}{
+		{"autohurl_files_posted_total", "counter", "Files posted.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.stats.Posted.Load()) }},
+		{"autohurl_files_failed_total", "counter", "Failed attempts to post a file.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.stats.Failed.Load()) }},
+		{"autohurl_files_moved_failed_total", "counter", "Files moved to movefailedto.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.stats.Moved.Load()) }},
+		{"autohurl_bytes_sent_total", "counter", "Bytes of files posted.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.stats.Sent.Load()) }},
+		{"autohurl_bytes_received_total", "counter", "Bytes of responses received.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.stats.Received.Load()) }},
+		{"autohurl_bytes_raw_total", "counter", "Bytes of compressed posts before compression.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.stats.Raw.Load()) }},
+		{"autohurl_bytes_encoded_total", "counter", "Bytes of compressed posts after compression.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.stats.Encoded.Load()) }},
+		{"autohurl_backlog_files", "gauge", "Files found in the folder by the last full scan.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.stats.Backlog.Load()) }},
+		{"autohurl_inflight_files", "gauge", "Files being posted.",
+			func(cfg *FolderCfg) float64 { return float64(cfg.inflight.Len()) }},
+		{"autohurl_oldest_file_age_seconds", "gauge", "Age of the oldest file found by the last full scan.",
+			func(cfg *FolderCfg) float64 {
+				oldest := cfg.stats.Oldest.Load()
+				if oldest == 0 {
+					return 0
+				}
+				return now.Sub(time.Unix(0, oldest)).Seconds()
+			}},
+	}
+	for _, m := range simple {
+		writeHeader(w, m.name, m.kind, m.help)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{folder=%s} %s\n", m.name, labelValue(name), formatValue(m.value(cfg[name])))
+		}
+	}
+
+	writeHeader(w, "autohurl_responses_total", "counter", "HTTP responses by status code.")
+	for _, name := range names {
+		statuses, _, _, _ := cfg[name].stats.responses()
+		codes := make([]int, 0, len(statuses))
+		for code := range statuses {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "autohurl_responses_total{folder=%s,code=\"%d\"} %d\n", labelValue(name), code, statuses[code])
+		}
+	}
+
+	targets := make(map[string]map[string]targetStats, len(names))
+	for _, name := range names {
+		targets[name] = cfg[name].stats.targetTotals()
+	}
+	target := []struct {
+		name, help string
+		value      func(t targetStats) int64
+	}{
+		{"autohurl_target_posted_total", "Files accepted by a URL.", func(t targetStats) int64 { return t.Posted }},
+		{"autohurl_target_failed_total", "Failed attempts to post a file to a URL.", func(t targetStats) int64 { return t.Failed }},
+	}
+	for _, m := range target {
+		writeHeader(w, m.name, "counter", m.help)
+		for _, name := range names {
+			for _, url := range cfg[name].Targets() {
+				fmt.Fprintf(w, "%s{folder=%s,url=%s} %d\n", m.name, labelValue(name), labelValue(url), m.value(targets[name][url]))
+			}
+		}
+	}
+
+	writeHeader(w, "autohurl_response_seconds", "histogram", "Time taken to post a file and read the response.")
+	for _, name := range names {
+		_, buckets, count, sum := cfg[name].stats.responses()
+		folder := labelValue(name)
+		for i, le := range responseBuckets {
+			fmt.Fprintf(w, "autohurl_response_seconds_bucket{folder=%s,le=\"%s\"} %d\n", folder, formatValue(le), buckets[i])
+		}
+		fmt.Fprintf(w, "autohurl_response_seconds_bucket{folder=%s,le=\"+Inf\"} %d\n", folder, count)
+		fmt.Fprintf(w, "autohurl_response_seconds_sum{folder=%s} %s\n", folder, formatValue(sum))
+		fmt.Fprintf(w, "autohurl_response_seconds_count{folder=%s} %d\n", folder, count)
+	}
+}
+
+// writeHeader writes the help and type lines of a metric
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelReplacer escapes label values
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes a label value
+func labelValue(s string) string {
+	return `"` + labelReplacer.Replace(s) + `"`
+}
+
+// formatValue formats a sample value
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	now := time.Now()
+	newFolder := func(urls ...string) *FolderCfg {
+		cfg := &FolderCfg{URL: urls[0], URLs: urls[1:]}
+		cfg.stats = new(folderStats)
+		cfg.inflight = newInFlight()
+		return cfg
+	}
+	a := newFolder("http://a/1", "http://a/2")
+	a.stats.Posted.Add(3)
+	a.stats.Failed.Add(1)
+	a.stats.Moved.Add(1)
+	a.stats.Sent.Add(1500)
+	a.stats.EndPass(7, now.Add(-90*time.Second))
+	a.stats.Response(200, 20*time.Millisecond)
+	a.stats.Response(200, 2*time.Second)
+	a.stats.Response(503, 40*time.Second)
+	a.stats.Target("http://a/1", true)
+	a.stats.Target("http://a/2", false)
+	a.inflight.Claim("x.txt")
+	b := newFolder("http://b/")
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeMetrics(w, map[string]*FolderCfg{"b": b, `a "1"`: a}, now)
+	w.Flush()
+	out := buf.String()
+
+	for _, line := range []string{
+		"# HELP autohurl_files_posted_total Files posted.",
+		"# TYPE autohurl_files_posted_total counter",
+		`autohurl_files_posted_total{folder="a \"1\""} 3`,
+		`autohurl_files_posted_total{folder="b"} 0`,
+		`autohurl_files_failed_total{folder="a \"1\""} 1`,
+		`autohurl_files_moved_failed_total{folder="a \"1\""} 1`,
+		`autohurl_bytes_sent_total{folder="a \"1\""} 1500`,
+		"# TYPE autohurl_backlog_files gauge",
+		`autohurl_backlog_files{folder="a \"1\""} 7`,
+		`autohurl_inflight_files{folder="a \"1\""} 1`,
+		`autohurl_oldest_file_age_seconds{folder="a \"1\""} 90`,
+		`autohurl_oldest_file_age_seconds{folder="b"} 0`,
+		`autohurl_responses_total{folder="a \"1\"",code="200"} 2`,
+		`autohurl_responses_total{folder="a \"1\"",code="503"} 1`,
+		`autohurl_target_posted_total{folder="a \"1\"",url="http://a/1"} 1`,
+		`autohurl_target_failed_total{folder="a \"1\"",url="http://a/2"} 1`,
+		`autohurl_target_posted_total{folder="b",url="http://b/"} 0`,
+		"# TYPE autohurl_response_seconds histogram",
+		`autohurl_response_seconds_bucket{folder="a \"1\"",le="0.025"} 1`,
+		`autohurl_response_seconds_bucket{folder="a \"1\"",le="2.5"} 2`,
+		`autohurl_response_seconds_bucket{folder="a \"1\"",le="30"} 2`,
+		`autohurl_response_seconds_bucket{folder="a \"1\"",le="+Inf"} 3`,
+		`autohurl_response_seconds_sum{folder="a \"1\""} 42.02`,
+		`autohurl_response_seconds_count{folder="a \"1\""} 3`,
+		`autohurl_response_seconds_count{folder="b"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing line %s", line)
+		}
+	}
+
+	// folders are listed in order
+	if strings.Index(out, `autohurl_files_posted_total{folder="a \"1\""}`) > strings.Index(out, `autohurl_files_posted_total{folder="b"}`) {
+		t.Error("folders not sorted")
+	}
+
+	// every sample follows the help and type of its metric
+	sample := regexp.MustCompile(`^([a-z_]+)\{[a-z]+="(?:[^"\\]|\\.)*"(?:,[a-z]+="(?:[^"\\]|\\.)*")*\} \S+$`)
+	typed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			typed[strings.Fields(line)[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		m := sample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("malformed line %q", line)
+			continue
+		}
+		name := m[1]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, suffix); base != name && typed[base] {
+				name = base
+			}
+		}
+		if !typed[name] {
+			t.Errorf("sample before its type: %q", line)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	if got, want := labelValue("a\\b\"c\nd"), `"a\\b\"c\nd"`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+// body modes
+const (
+	BodyRaw       = "raw"       // the file is the request body
+	BodyMultipart = "multipart" // the file is a part of a multipart/form-data body
+)
+
+// quoteEscaper escapes quotes in a Content-Disposition parameter, as mime/multipart does
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// multipartBody wraps the contents of a file in a multipart/form-data body,
+// with the form fields before the file. Only the fields and part headers are
+// held in memory; the file is streamed. It returns the body, its length and
+// its content type.
+func multipartBody(spec *requestSpec, file io.Reader, size int64, ct string) (io.Reader, int64, string, error) {
+	var head bytes.Buffer
+	w := multipart.NewWriter(&head)
+	for _, f := range spec.fields {
+		if err := w.WriteField(f.Key, f.Value); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(spec.fieldName), quoteEscaper.Replace(spec.fileName)))
+	h.Set("Content-Type", ct)
+	if _, err := w.CreatePart(h); err != nil {
+		return nil, 0, "", err
+	}
+
+	// everything written from here on follows the file
+	var tail bytes.Buffer
+	prefix := head.Len()
+	if err := w.Close(); err != nil {
+		return nil, 0, "", err
+	}
+	tail.Write(head.Bytes()[prefix:])
+	head.Truncate(prefix)
+
+	length := int64(head.Len()) + size + int64(tail.Len())
+	return io.MultiReader(&head, file, &tail), length, w.FormDataContentType(), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func TestMultipartBody(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	spec := &requestSpec{
+		fields:    []hdr{{Key: "source", Value: "autohurl"}, {Key: "note", Value: "ünïcode \"quoted\""}},
+		fieldName: "file",
+		fileName:  `data "1".txt`,
+	}
+	body, length, ct, err := multipartBody(spec, strings.NewReader(content), int64(len(content)), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != length {
+		t.Fatalf("body is %d bytes, length says %d", len(data), length)
+	}
+
+	// the body parses back into the fields and the file
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil || mt != "multipart/form-data" {
+		t.Fatalf("content type %q: %v", ct, err)
+	}
+	r := multipart.NewReader(bytes.NewReader(data), params["boundary"])
+	var names []string
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _ := ioutil.ReadAll(p)
+		names = append(names, p.FormName())
+		if p.FormName() == "file" {
+			if p.FileName() != spec.fileName {
+				t.Errorf("file name %q, want %q", p.FileName(), spec.fileName)
+			}
+			if got := p.Header.Get("Content-Type"); got != "text/plain" {
+				t.Errorf("file content type %q", got)
+			}
+			if string(v) != content {
+				t.Errorf("file content differs")
+			}
+		}
+	}
+	if strings.Join(names, ",") != "source,note,file" {
+		t.Errorf("parts %v, want the fields before the file", names)
+	}
+}
+
+func TestMultipartBodyEmpty(t *testing.T) {
+	body, length, _, err := multipartBody(&requestSpec{fieldName: "file", fileName: "empty"}, strings.NewReader(""), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != length {
+		t.Errorf("body is %d bytes, length says %d", n, length)
+	}
+}
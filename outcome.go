@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// outcome is what to do with a file after an attempt to post it
+type outcome int
+
+// outcome definitions
+const (
+	OutcomeSuccess outcome = iota // the file was posted
+	OutcomeRetry                  // try again later, moving the file to movefailedto once attempts are used up
+	OutcomeFail                   // move the file to movefailedto right away
+	OutcomeLeave                  // leave the file in the folder without retrying it
+)
+
+// String returns the name of an outcome as used in the outcomes setting
+func (o outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeRetry:
+		return "retry"
+	case OutcomeFail:
+		return "fail"
+	case OutcomeLeave:
+		return "leave"
+	}
+	return "unknown"
+}
+
+// transport error classes
+const (
+	ClassTimeout = "timeout" // the request or connection timed out
+	ClassRefused = "refused" // the connection was refused
+	ClassReset   = "reset"   // the connection was closed early
+	ClassDNS     = "dns"     // the host name could not be resolved
+	ClassTLS     = "tls"     // the TLS handshake or certificate check failed
+	ClassProxy   = "proxy"   // the proxy could not be reached or refused the connection
+	ClassError   = "error"   // any other transport error
+)
+
+// defaultOutcomes is applied after any outcomes configured for a folder
+const defaultOutcomes = "2xx=success,408=retry,425=retry,429=retry,4xx=fail,501=fail,505=fail,5xx=retry,1xx=retry,3xx=retry," +
+	"timeout=retry,refused=retry,reset=retry,dns=retry,tls=retry,proxy=retry,error=retry"
+
+// outcome rule structure - either a status code range or a transport error class
+type outcomeRule struct {
+	Low    int
+	High   int
+	Class  string
+	Action outcome
+}
+
+// parseOutcomes parses a comma-separated list of rules like "404=leave" or "4xx=fail"
+func parseOutcomes(text string) ([]outcomeRule, error) {
+	var rules []outcomeRule
+	for _, r := range strings.Split(text, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		rarr := strings.SplitN(r, "=", 2)
+		if len(rarr) != 2 {
+			return nil, errors.New("Unable to parse outcome: " + r)
+		}
+		var rule outcomeRule
+		switch strings.ToLower(strings.TrimSpace(rarr[1])) {
+		case "success":
+			rule.Action = OutcomeSuccess
+		case "retry":
+			rule.Action = OutcomeRetry
+		case "fail":
+			rule.Action = OutcomeFail
+		case "leave":
+			rule.Action = OutcomeLeave
+		default:
+			return nil, errors.New("Unknown outcome action: " + r)
+		}
+		match := strings.ToLower(strings.TrimSpace(rarr[0]))
+		switch {
+		case match == ClassTimeout || match == ClassRefused || match == ClassReset ||
+			match == ClassDNS || match == ClassTLS || match == ClassProxy || match == ClassError:
+			rule.Class = match
+		case len(match) == 3 && strings.HasSuffix(match, "xx") && match[0] >= '1' && match[0] <= '5':
+			rule.Low = int(match[0]-'0') * 100
+			rule.High = rule.Low + 99
+		default:
+			lo, hi := match, match
+			if i := strings.Index(match, "-"); i >= 0 {
+				lo, hi = match[:i], match[i+1:]
+			}
+			var err1, err2 error
+			rule.Low, err1 = strconv.Atoi(strings.TrimSpace(lo))
+			rule.High, err2 = strconv.Atoi(strings.TrimSpace(hi))
+			if err1 != nil || err2 != nil || rule.Low < 100 || rule.High > 599 || rule.Low > rule.High {
+				return nil, errors.New("Unable to parse outcome status: " + r)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// statusOutcome returns the action for an HTTP status code
+func statusOutcome(rules []outcomeRule, status int) outcome {
+	for _, r := range rules {
+		if r.Class == "" && status >= r.Low && status <= r.High {
+			return r.Action
+		}
+	}
+	if status >= 200 && status <= 299 {
+		return OutcomeSuccess
+	}
+	return OutcomeRetry
+}
+
+// errorOutcome returns the action for a transport error
+func errorOutcome(rules []outcomeRule, err error) outcome {
+	class := errorClass(err)
+	for _, r := range rules {
+		if r.Class == class {
+			return r.Action
+		}
+	}
+	return OutcomeRetry
+}
+
+// errorClass classifies a transport error
+func errorClass(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var authErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	var hostErr x509.HostnameError
+	var recErr tls.RecordHeaderError
+	switch {
+	case isProxyError(err):
+		return ClassProxy
+	case errors.As(err, &dnsErr):
+		return ClassDNS
+	case errors.As(err, &authErr), errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &recErr):
+		return ClassTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ClassRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ClassReset
+	case strings.Contains(err.Error(), "tls: "):
+		return ClassTLS
+	}
+	return ClassError
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ProxyEnvironment takes the proxy from HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+const ProxyEnvironment = "environment"
+
+// proxyFunc picks the proxy of a request, as in http.Transport
+type proxyFunc func(*http.Request) (*url.URL, error)
+
+// ParseProxy works out the proxy of a folder
+func (c *FolderCfg) ParseProxy() error {
+	c.proxy = nil
+	switch c.Proxy {
+	case "":
+		return nil
+	case ProxyEnvironment:
+		c.proxy = http.ProxyFromEnvironment
+		return nil
+	}
+	u, err := url.Parse(c.Proxy)
+	if err != nil {
+		return fmt.Errorf("proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("proxy %s: unsupported scheme %q", u.Redacted(), u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy %s: no host", u.Redacted())
+	}
+	c.proxy = http.ProxyURL(u)
+	return nil
+}
+
+// proxyError is a proxy's refusal to open a tunnel to the endpoint
+type proxyError struct {
+	proxy  string // proxy URL without credentials
+	status string // status of the response to CONNECT
+}
+
+func (e *proxyError) Error() string {
+	return "proxy " + e.proxy + ": " + e.status
+}
+
+// checkProxyConnect turns a failed CONNECT into a proxyError
+func checkProxyConnect(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return &proxyError{proxy: proxyURL.Redacted(), status: resp.Status}
+	}
+	return nil
+}
+
+// isProxyError returns whether a transport error came from the proxy rather
+// than the endpoint
+func isProxyError(err error) bool {
+	var pe *proxyError
+	if errors.As(err, &pe) {
+		return true
+	}
+	// the transport marks failures to reach an http proxy, and SOCKS failures
+	// are reported by the SOCKS dialer
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks "))
+}
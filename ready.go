@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// readiness decides whether a file has been completely written and can be posted
+type readiness struct {
+	name   string
+	cfg    *FolderCfg
+	ignore []string
+	stable map[string]stableInfo
+	pass   int
+}
+
+// stableInfo records the size and modification time of a file at the last scan
+type stableInfo struct {
+	size    int64
+	modTime time.Time
+	scans   int
+	pass    int
+}
+
+// newReadiness creates a readiness checker for a folder
+func newReadiness(name string, cfg *FolderCfg) *readiness {
+	r := &readiness{
+		name:   name,
+		cfg:    cfg,
+		stable: make(map[string]stableInfo),
+	}
+	for _, pat := range strings.Split(cfg.Ignore, ",") {
+		pat = strings.TrimSpace(pat)
+		if pat == "" {
+			continue
+		}
+		if _, err := filepath.Match(pat, ""); err != nil {
+			log.Print(name, ": Bad ignore pattern ", pat, ": ", err)
+			continue
+		}
+		r.ignore = append(r.ignore, pat)
+	}
+	return r
+}
+
+// Skip returns whether a file name should never be posted, because it is a
+// temporary file, a ready marker or sidecar metadata
+func (r *readiness) Skip(fn string) bool {
+	if r.cfg.ReadyMarker != "" && strings.HasSuffix(fn, r.cfg.ReadyMarker) {
+		return true
+	}
+	if isMeta(r.cfg, fn) {
+		return true
+	}
+	for _, pat := range r.ignore {
+		if matched, _ := filepath.Match(pat, fn); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Ready returns whether a file is ready to be posted. Each call counts as a
+// scan of the file for the stability check.
+func (r *readiness) Ready(inf os.FileInfo) bool {
+	// size and modification time unchanged for a number of scans
+	if r.cfg.StableScans > 0 {
+		si, ok := r.stable[inf.Name()]
+		if ok && si.size == inf.Size() && si.modTime.Equal(inf.ModTime()) {
+			si.scans++
+		} else {
+			si = stableInfo{size: inf.Size(), modTime: inf.ModTime()}
+		}
+		si.pass = r.pass
+		r.stable[inf.Name()] = si
+		if si.scans < r.cfg.StableScans {
+			return false
+		}
+	}
+
+	// minimum age since last modification
+	if r.cfg.MinAge > 0 && time.Since(inf.ModTime()) < time.Duration(r.cfg.MinAge) {
+		return false
+	}
+
+	// companion marker file
+	if r.cfg.ReadyMarker != "" {
+		if _, err := os.Lstat(filepath.Join(r.cfg.Folder, inf.Name()+r.cfg.ReadyMarker)); err != nil {
+			return false
+		}
+	}
+
+	// advisory lock held by the writer
+	if r.cfg.Flock {
+		locked, err := isLocked(filepath.Join(r.cfg.Folder, inf.Name()))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Print(r.name, ": Unable to check lock on ", inf.Name(), ": ", err)
+			}
+			return false
+		}
+		if locked {
+			return false
+		}
+	}
+
+	delete(r.stable, inf.Name())
+	return true
+}
+
+// minRecheck is the shortest wait before checking a file again
+const minRecheck = 10 * time.Millisecond
+
+// Recheck returns how long to wait before checking again a file that was not
+// ready: until it is old enough if minage holds it back, otherwise sleeptime
+func (r *readiness) Recheck(inf os.FileInfo) time.Duration {
+	if r.cfg.MinAge > 0 {
+		if d := time.Until(inf.ModTime().Add(time.Duration(r.cfg.MinAge))); d > 0 {
+			if d < minRecheck {
+				d = minRecheck
+			}
+			return d
+		}
+	}
+	return time.Duration(r.cfg.SleepTime)
+}
+
+// EndPass forgets files that were not seen during the last full pass of the folder
+func (r *readiness) EndPass() {
+	for fn, si := range r.stable {
+		if si.pass != r.pass {
+			delete(r.stable, fn)
+		}
+	}
+	r.pass++
+}
+
+// removeMarker removes the ready marker of a file that has left the folder
+func removeMarker(name string, cfg *FolderCfg, inf os.FileInfo) {
+	if cfg.ReadyMarker == "" {
+		return
+	}
+	marker := filepath.Join(cfg.Folder, inf.Name()+cfg.ReadyMarker)
+	err := os.Remove(marker)
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(name, ": failed to remove ready marker ", marker, ": ", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ancientlore/flagcfg"
+)
+
+// replayOptions are the options of the replay command
+type replayOptions struct {
+	from   string
+	match  string
+	older  time.Duration
+	newer  time.Duration
+	dryRun bool
+}
+
+// replayFlags creates the flags of the replay command
+func replayFlags(o *replayOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.StringVar(&o.from, "from", "failed", "Folder to replay: failed (movefailedto) or archive (moveto).")
+	fs.StringVar(&o.match, "match", "*", "Pattern of files to replay.")
+	fs.DurationVar(&o.older, "older", 0, "Only replay files last modified longer ago than this.")
+	fs.DurationVar(&o.newer, "newer", 0, "Only replay files last modified more recently than this.")
+	fs.BoolVar(&o.dryRun, "dryrun", false, "List the files that would be replayed without posting them.")
+	return fs
+}
+
+// replaySummary counts the results of a replay
+type replaySummary struct {
+	mu      sync.Mutex
+	posted  int
+	failed  int
+	skipped int
+	bytes   int64
+}
+
+// replayCommand re-posts files from the failed or archive folder of a configured folder,
+// returning the exit code
+func replayCommand(args []string) int {
+	var o replayOptions
+	fs := replayFlags(&o)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		log.Print("replay: expected the name of one folder")
+		return 2
+	}
+	name := fs.Arg(0)
+	if _, err := filepath.Match(o.match, ""); err != nil {
+		log.Print("replay: bad pattern ", o.match, ": ", err)
+		return 2
+	}
+
+	cfg, err := loadFolders(flagcfg.Filename(), &defaultCfg)
+	if err != nil {
+		log.Print("replay: ", err)
+		return 1
+	}
+	fldr, ok := cfg[name]
+	if !ok {
+		log.Print("replay: folder not configured: ", name)
+		return 2
+	}
+	var dir string
+	switch o.from {
+	case "failed":
+		dir = fldr.MoveFailedTo
+	case "archive":
+		dir = fldr.MoveTo
+	default:
+		log.Print("replay: -from must be failed or archive")
+		return 2
+	}
+	if dir == "" {
+		log.Print("replay: folder ", name, " has no ", o.from, " folder configured")
+		return 2
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Print("replay: ", err)
+		return 1
+	}
+
+	setupClient(fldr)
+	fldr.breaker = newBreaker(name, fldr)
+	fldr.stats = new(folderStats)
+	fldr.journal = openJournal(fldr)
+
+	var sum replaySummary
+	start := time.Now()
+	ch := make(chan os.FileInfo)
+	var wg sync.WaitGroup
+	wg.Add(fldr.Conns)
+	for i := 0; i < fldr.Conns; i++ {
+		go func() {
+			defer wg.Done()
+			for inf := range ch {
+				replayFile(name, fldr, dir, o.from, inf, &sum)
+			}
+		}()
+	}
+
+	for _, ent := range entries {
+		if !ent.Type().IsRegular() || isFailureInfo(ent.Name()) || isClaimed(ent.Name()) || isMeta(fldr, ent.Name()) {
+			continue
+		}
+		if matched, _ := filepath.Match(o.match, ent.Name()); !matched {
+			continue
+		}
+		inf, err := ent.Info()
+		if err != nil {
+			log.Print("replay: ", err)
+			continue
+		}
+		if (o.older > 0 && time.Since(inf.ModTime()) < o.older) || (o.newer > 0 && time.Since(inf.ModTime()) > o.newer) {
+			continue
+		}
+		if fldr.MaxFileSize > 0 && inf.Size() > fldr.MaxFileSize && !chunked(fldr, inf) {
+			fmt.Printf("skip %s: %d bytes is over the maximum size\n", inf.Name(), inf.Size())
+			sum.skipped++
+			continue
+		}
+		if o.dryRun {
+			fmt.Printf("would post %s (%d bytes)\n", inf.Name(), inf.Size())
+			sum.posted++
+			sum.bytes += inf.Size()
+			continue
+		}
+		ch <- inf
+	}
+	close(ch)
+	wg.Wait()
+
+	verb := "posted"
+	if o.dryRun {
+		verb = "to post"
+	}
+	fmt.Printf("%s: %d %s, %d failed, %d skipped, %d bytes in %s\n",
+		name, sum.posted, verb, sum.failed, sum.skipped, sum.bytes, time.Since(start).Round(time.Millisecond))
+	if sum.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayFile re-posts one file. Replayed failed files are archived or removed
+// like newly posted files; replayed archived files stay where they are.
+func replayFile(name string, cfg *FolderCfg, dir, from string, inf os.FileInfo, sum *replaySummary) {
+	fname := filepath.Join(dir, inf.Name())
+	rec := newAuditRecord(name, cfg, inf)
+	rec.Attempt = 1
+	rec.Disposition = DispKept
+	defer cfg.journal.Write(rec)
+	err := postFile(context.Background(), name, cfg, fname, inf, rec)
+	sum.mu.Lock()
+	defer sum.mu.Unlock()
+	if err != nil {
+		fmt.Printf("failed %s: %s\n", inf.Name(), err)
+		rec.Error = err.Error()
+		sum.failed++
+		return
+	}
+	fmt.Printf("posted %s\n", inf.Name())
+	sum.posted++
+	sum.bytes += inf.Size()
+	if from != "failed" {
+		return
+	}
+	if cfg.MoveTo == "" {
+		rec.Disposition = DispDeleted
+		err = os.Remove(fname)
+	} else {
+		rec.Disposition = DispMoved
+		err = os.Rename(fname, filepath.Join(cfg.MoveTo, inf.Name()))
+	}
+	if err != nil {
+		log.Print(name, ": failed to clean up replayed file ", fname, ": ", err)
+		rec.Disposition, rec.Error = DispKept, err.Error()
+		return
+	}
+	moveMeta(name, cfg, dir, inf.Name(), cfg.MoveTo)
+	err = os.Remove(fname + failureSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(name, ": failed to remove failure info for ", fname, ": ", err)
+	}
+}
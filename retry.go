@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// retryFile is the name of the file in the state folder that holds retry attempts
+const retryFile = "retries.json"
+
+// retryEntry is the retry status of a file that failed to post
+type retryEntry struct {
+	Attempts  int       `json:"attempts"`            // number of failed attempts
+	Next      time.Time `json:"next"`                // earliest time for the next attempt
+	First     time.Time `json:"first"`               // time of the first failure
+	Last      time.Time `json:"last"`                // time of the last failure
+	LastError string    `json:"lastError"`           // reason for the last failure
+	Left      bool      `json:"left"`                // not retried while the file remains in the folder
+	Delivered []string  `json:"delivered,omitempty"` // URLs that already have the file when posting to all of them
+	pass      int       // last full scan of the folder that saw the file
+}
+
+// retryState tracks failed files of a folder and when they may be retried.
+// It is saved to disk so that attempt counts survive restarts.
+type retryState struct {
+	mu    sync.Mutex
+	name  string
+	cfg   *FolderCfg
+	fn    string
+	files map[string]*retryEntry
+	pass  int
+}
+
+// newRetryState creates the retry state for a folder, loading any saved state
+func newRetryState(name string, cfg *FolderCfg) *retryState {
+	r := &retryState{
+		name:  name,
+		cfg:   cfg,
+		fn:    filepath.Join(stateDir(name, cfg), retryFile),
+		files: make(map[string]*retryEntry),
+	}
+	data, err := ioutil.ReadFile(r.fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(name, ": Unable to read retry state: ", err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r.files); err != nil {
+		log.Print(name, ": Unable to parse retry state ", r.fn, ": ", err)
+		r.files = make(map[string]*retryEntry)
+	}
+	return r
+}
+
+// stateDir returns the folder where autohurl keeps state for a folder
+func stateDir(name string, cfg *FolderCfg) string {
+	if cfg.StateDir != "" {
+		return filepath.Join(cfg.StateDir, name)
+	}
+	return filepath.Join(cfg.Folder, ".autohurl")
+}
+
+// Due returns whether a file may be posted now. It also notes that the file
+// is still in the folder.
+func (r *retryState) Due(fn string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.files[fn]
+	if !ok {
+		return true
+	}
+	e.pass = r.pass
+	return !e.Left && !time.Now().Before(e.Next)
+}
+
+// NextDue returns the earliest time a failed file may be retried, or the zero time if there is none
+func (r *retryState) NextDue() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var t time.Time
+	for _, e := range r.files {
+		if e.Left {
+			continue
+		}
+		if t.IsZero() || e.Next.Before(t) {
+			t = e.Next
+		}
+	}
+	return t
+}
+
+// Failed records a failed attempt and schedules the next one, returning the updated retry status
+func (r *retryState) Failed(fn string, err error) retryEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.failed(fn, err)
+	delay := backoff(r.cfg, e.Attempts)
+	if pe, ok := err.(postError); ok && pe.retryAfter > delay {
+		// the server knows best
+		delay = pe.retryAfter
+	}
+	e.Next = e.Last.Add(delay)
+	r.save()
+	return *e
+}
+
+// failed records a failed attempt; the lock must be held
+func (r *retryState) failed(fn string, err error) *retryEntry {
+	e, ok := r.files[fn]
+	if !ok {
+		e = &retryEntry{pass: r.pass}
+		r.files[fn] = e
+	}
+	e.Attempts++
+	e.Last = time.Now()
+	if e.First.IsZero() {
+		e.First = e.Last
+	}
+	e.LastError = err.Error()
+	if pe, ok := err.(postError); ok {
+		e.Delivered = pe.delivered
+	}
+	return e
+}
+
+// Leave records a failed attempt for a file that should not be retried while it remains in the folder
+func (r *retryState) Leave(fn string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.failed(fn, err)
+	e.Left = true
+	r.save()
+}
+
+// Done forgets a file that was posted or given up on
+func (r *retryState) Done(fn string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.files[fn]; ok {
+		delete(r.files, fn)
+		r.save()
+	}
+}
+
+// EndPass forgets files that were not seen during the last full pass of the folder
+func (r *retryState) EndPass() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := false
+	for fn, e := range r.files {
+		if e.pass != r.pass {
+			delete(r.files, fn)
+			changed = true
+		}
+	}
+	r.pass++
+	if changed {
+		r.save()
+	}
+}
+
+// Attempts returns the number of failed attempts to post a file
+func (r *retryState) Attempts(fn string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.files[fn]; ok {
+		return e.Attempts
+	}
+	return 0
+}
+
+// Delivered returns the URLs that already have a file when posting to all of
+// them; a nil retry state, as used by replay, has none
+func (r *retryState) Delivered(fn string) []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.files[fn]; ok {
+		return e.Delivered
+	}
+	return nil
+}
+
+// Len returns the number of failed files being tracked
+func (r *retryState) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.files)
+}
+
+// save writes the retry state to disk; the lock must be held
+func (r *retryState) save() {
+	data, err := json.MarshalIndent(r.files, "", "\t")
+	if err != nil {
+		log.Print(r.name, ": Unable to encode retry state: ", err)
+		return
+	}
+	err = writeFileAtomic(r.fn, data)
+	if err != nil {
+		log.Print(r.name, ": Unable to save retry state: ", err)
+	}
+}
+
+// writeFileAtomic writes a file by way of a temporary file so that readers never see a partial file
+func writeFileAtomic(fn string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns the delay before the given attempt, doubling from the base
+// delay up to the maximum and spreading it by the jitter fraction
+func backoff(cfg *FolderCfg, attempts int) time.Duration {
+	d := time.Duration(cfg.Backoff)
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d <= 0 || (cfg.MaxBackoff > 0 && d > time.Duration(cfg.MaxBackoff)) {
+			d = time.Duration(cfg.MaxBackoff)
+			break
+		}
+	}
+	if cfg.Jitter > 0 {
+		jitterMu.Lock()
+		f := 1 + cfg.Jitter*(2*jitterRand.Float64()-1)
+		jitterMu.Unlock()
+		d = time.Duration(float64(d) * f)
+	}
+	return d
+}
+
+// retryAfter parses the Retry-After header of a response, in seconds or as an HTTP date
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
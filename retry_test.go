@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	cfg := &FolderCfg{DefaultCfg: DefaultCfg{Backoff: duration(time.Second), MaxBackoff: duration(10 * time.Second)}}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(cfg, tt.attempts); got != tt.want {
+			t.Errorf("attempt %d: got %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+
+	// the delay stays within the jitter fraction
+	cfg.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := backoff(cfg, 3); got < 2*time.Second || got > 6*time.Second {
+			t.Fatalf("jittered delay %s out of range", got)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header   string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"120", 120 * time.Second, 120 * time.Second},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(resp); got < tt.min || got > tt.max {
+			t.Errorf("%q: got %s, want between %s and %s", tt.header, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryStateEndPass(t *testing.T) {
+	cfg := &FolderCfg{DefaultCfg: DefaultCfg{StateDir: t.TempDir(), Backoff: duration(time.Hour)}}
+	r := newRetryState("test", cfg)
+	r.Failed("kept", errors.New("failed"))
+	r.Failed("gone", errors.New("failed"))
+
+	// files that failed during a pass are kept at its end
+	r.EndPass()
+	if r.Len() != 2 {
+		t.Fatalf("got %d files after the first pass, want 2", r.Len())
+	}
+
+	// a file not seen during a full pass is forgotten
+	if r.Due("kept") {
+		t.Error("file due before its backoff")
+	}
+	r.EndPass()
+	if r.Len() != 1 || r.Attempts("kept") != 1 || r.Attempts("gone") != 0 {
+		t.Fatalf("got %d files after the second pass, want only the one seen", r.Len())
+	}
+
+	// the state is saved and loaded again
+	r = newRetryState("test", cfg)
+	if r.Attempts("kept") != 1 || r.Attempts("gone") != 0 {
+		t.Errorf("loaded attempts: kept %d, gone %d", r.Attempts("kept"), r.Attempts("gone"))
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// responseBuckets are the upper bounds in seconds of the response time histogram
+var responseBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// folderStats are running totals for a folder
+type folderStats struct {
+	Posted   atomic.Int64 // files posted
+	Failed   atomic.Int64 // failed attempts to post a file
+	Moved    atomic.Int64 // files moved to movefailedto
+	Sent     atomic.Int64 // bytes sent
+	Received atomic.Int64 // bytes received
+	Raw      atomic.Int64 // bytes of compressed posts before compression
+	Encoded  atomic.Int64 // bytes of compressed posts after compression
+	Backlog  atomic.Int64 // files found by the last full scan
+	Oldest   atomic.Int64 // modification time in Unix nanoseconds of the oldest file found by the last full scan, 0 if none
+
+	mu       sync.Mutex
+	statuses map[int]int64 // responses by status code
+	buckets  []int64       // responses by response time, counted like responseBuckets
+	count    int64         // number of responses
+	sum      float64       // total response time in seconds
+	targets  map[string]*targetStats
+}
+
+// targetStats are running totals for one of a folder's URLs
+type targetStats struct {
+	Posted int64 // files accepted
+	Failed int64 // failed attempts
+}
+
+// Target records the result of posting a file to one of the folder's URLs
+func (s *folderStats) Target(url string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.targets == nil {
+		s.targets = make(map[string]*targetStats)
+	}
+	t, found := s.targets[url]
+	if !found {
+		t = new(targetStats)
+		s.targets[url] = t
+	}
+	if ok {
+		t.Posted++
+	} else {
+		t.Failed++
+	}
+}
+
+// targetTotals returns a copy of the totals of each URL
+func (s *folderStats) targetTotals() map[string]targetStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	totals := make(map[string]targetStats, len(s.targets))
+	for url, t := range s.targets {
+		totals[url] = *t
+	}
+	return totals
+}
+
+// Response records an HTTP response and how long it took
+func (s *folderStats) Response(status int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.statuses == nil {
+		s.statuses = make(map[int]int64)
+		s.buckets = make([]int64, len(responseBuckets))
+	}
+	s.statuses[status]++
+	secs := d.Seconds()
+	for i, le := range responseBuckets {
+		if secs <= le {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.sum += secs
+}
+
+// EndPass records the backlog found by a full scan of the folder
+func (s *folderStats) EndPass(backlog int, oldest time.Time) {
+	s.Backlog.Store(int64(backlog))
+	if oldest.IsZero() {
+		s.Oldest.Store(0)
+	} else {
+		s.Oldest.Store(oldest.UnixNano())
+	}
+}
+
+// responses returns a copy of the response counts
+func (s *folderStats) responses() (statuses map[int]int64, buckets []int64, count int64, sum float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses = make(map[int]int64, len(s.statuses))
+	for k, v := range s.statuses {
+		statuses[k] = v
+	}
+	buckets = make([]int64, len(responseBuckets))
+	copy(buckets, s.buckets)
+	return statuses, buckets, s.count, s.sum
+}
+
+// printSummary prints the totals of each folder and returns the number of
+// files that failed: those moved to movefailedto and those still waiting for
+// a retry or left in place
+func printSummary(cfg map[string]*FolderCfg, d time.Duration) int64 {
+	var posted, failed, attempts, sent, received int64
+	for _, name := range sortedNames(cfg) {
+		st := cfg[name].stats
+		f := st.Moved.Load() + int64(cfg[name].retries.Len())
+		fmt.Printf("%s: %d posted, %d failed, %d failed attempts, %d bytes sent, %d bytes received\n",
+			name, st.Posted.Load(), f, st.Failed.Load(), st.Sent.Load(), st.Received.Load())
+		posted += st.Posted.Load()
+		failed += f
+		attempts += st.Failed.Load()
+		sent += st.Sent.Load()
+		received += st.Received.Load()
+	}
+	fmt.Printf("total: %d posted, %d failed, %d failed attempts, %d bytes sent, %d bytes received in %s\n",
+		posted, failed, attempts, sent, received, d.Round(time.Millisecond))
+	return failed
+}
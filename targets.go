@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// URL modes
+const (
+	URLModeAll        = "all"        // post to every URL
+	URLModeFailover   = "failover"   // post to the first URL that accepts the file
+	URLModeRoundRobin = "roundrobin" // spread the posts over the URLs
+)
+
+// Targets returns the URLs a folder posts to
+func (c *FolderCfg) Targets() []string {
+	var urls []string
+	if c.URL != "" {
+		urls = append(urls, c.URL)
+	}
+	return append(urls, c.URLs...)
+}
+
+// CheckTargets checks the URL settings
+func (c *FolderCfg) CheckTargets() error {
+	n := len(c.Targets())
+	if n == 0 {
+		return errors.New("no url configured")
+	}
+	switch c.URLMode {
+	case URLModeAll, URLModeFailover, URLModeRoundRobin:
+	default:
+		return fmt.Errorf("unknown urlmode %q", c.URLMode)
+	}
+	if c.Quorum < 0 || c.Quorum > n {
+		return fmt.Errorf("quorum %d is not between 0 and the %d urls", c.Quorum, n)
+	}
+	return nil
+}
+
+// target is one of the URLs a file is posted to
+type target struct {
+	name string // URL as configured, which names the target in metrics and retry state
+	url  string // URL for the file being posted
+}
+
+// postFile posts a file to the folder's URLs according to its URL mode,
+// filling in the details of the attempt in rec
+func postFile(ctx context.Context, name string, cfg *FolderCfg, fname string, inf os.FileInfo, rec *auditRecord) error {
+	urls, spec, err := prepareFile(cfg, fname, inf)
+	if err != nil {
+		// a file that cannot be described cannot be posted
+		log.Print(name, ": Unable to prepare ", inf.Name(), ": ", err)
+		return postError{err: err, action: OutcomeFail}
+	}
+	has := make(map[string]bool)
+	for _, t := range cfg.retries.Delivered(inf.Name()) {
+		has[t] = true
+	}
+	send := postTarget
+	if chunked(cfg, inf) {
+		send = uploadTarget
+	}
+	return postTargets(ctx, name, cfg, urls, has, func(url string) error {
+		return send(ctx, name, cfg, url, spec, fname, inf, rec)
+	}, rec)
+}
+
+// prepareFile works out the URLs and request of a file from the templates and
+// its sidecar metadata
+func prepareFile(cfg *FolderCfg, fname string, inf os.FileInfo) ([]string, *requestSpec, error) {
+	data := newFileData(cfg, inf)
+	urls, err := expandTargets(cfg, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	spec := &requestSpec{method: cfg.Method}
+	spec.headers, err = expandHeaders("header", cfg.Headers, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Body == BodyMultipart {
+		spec.fields, err = expandHeaders("field", cfg.Fields, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		spec.fieldName = cfg.FieldName
+		spec.fileName, err = expand(cfg.FileNameTmpl, cfg.FileName, data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("filename: %w", err)
+		}
+	}
+	meta, err := readMeta(cfg, filepath.Dir(fname), inf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = meta.apply(urls, spec); err != nil {
+		return nil, nil, err
+	}
+	for _, u := range urls {
+		if _, err = http.NewRequest(spec.method, u, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	return urls, spec, nil
+}
+
+// postTargets posts to the expanded URLs according to the URL mode, calling
+// send for each URL tried. In all mode, the URLs in has are skipped. A post
+// whose credentials are rejected is sent again once with fresh ones.
+func postTargets(ctx context.Context, name string, cfg *FolderCfg, urls []string, has map[string]bool, send func(url string) error, rec *auditRecord) error {
+	send = withReauth(name, cfg, send)
+	targets := make([]target, len(urls))
+	for i, t := range cfg.Targets() {
+		targets[i] = target{name: t, url: urls[i]}
+	}
+
+	var err error
+	switch cfg.URLMode {
+	case URLModeFailover:
+		err = postFailover(ctx, cfg, targets, send)
+	case URLModeRoundRobin:
+		// start with the next URL in turn, failing over to the others
+		start := int((atomic.AddUint64(&cfg.next, 1) - 1) % uint64(len(targets)))
+		targets = append(targets[start:len(targets):len(targets)], targets[:start]...)
+		err = postFailover(ctx, cfg, targets, send)
+	default:
+		err = postAll(ctx, cfg, targets, has, send, rec)
+	}
+
+	// the circuit breaker trips on endpoints that cannot be reached or ask for a retry
+	if pe, ok := err.(postError); ok {
+		if pe.status == 0 || pe.action == OutcomeRetry {
+			cfg.breaker.Failure()
+		} else {
+			cfg.breaker.Success()
+		}
+	} else if err == nil {
+		cfg.breaker.Success()
+	}
+	return err
+}
+
+// postFailover posts to each URL in turn until one accepts the post. A URL
+// that rejects it without asking for a retry stops the attempt.
+func postFailover(ctx context.Context, cfg *FolderCfg, targets []target, send func(url string) error) error {
+	var err error
+	for _, t := range targets {
+		err = send(t.url)
+		cfg.stats.Target(t.name, err == nil)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if pe, ok := err.(postError); !ok || pe.action != OutcomeRetry {
+			return err
+		}
+	}
+	return err
+}
+
+// postAll posts to every URL that does not have the post yet, succeeding once
+// the quorum of URLs have it. Failed URLs are tried again on the next attempt.
+func postAll(ctx context.Context, cfg *FolderCfg, targets []target, has map[string]bool, send func(url string) error, rec *auditRecord) error {
+	quorum := cfg.Quorum
+	if quorum == 0 {
+		quorum = len(targets)
+	}
+
+	var delivered []string
+	var failed []postError
+	for _, t := range targets {
+		if has[t.name] {
+			delivered = append(delivered, t.name)
+			continue
+		}
+		err := send(t.url)
+		cfg.stats.Target(t.name, err == nil)
+		if err == nil {
+			delivered = append(delivered, t.name)
+			continue
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		pe, ok := err.(postError)
+		if !ok {
+			// the file itself is the problem, so the other URLs would fail too
+			return err
+		}
+		failed = append(failed, pe)
+	}
+	if len(targets) > 1 {
+		rec.Delivered = delivered
+	}
+	if len(delivered) >= quorum {
+		return nil
+	}
+
+	// report the first failure, retrying if any of the URLs asked for it
+	pe := failed[0]
+	for _, f := range failed[1:] {
+		if f.action == OutcomeRetry || (f.action == OutcomeFail && pe.action == OutcomeLeave) {
+			pe = f
+		}
+	}
+	pe.delivered = delivered
+	return pe
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are the functions available to URL and header templates
+var templateFuncs = template.FuncMap{
+	"env":         os.Getenv,
+	"pathescape":  url.PathEscape,
+	"queryescape": url.QueryEscape,
+	"lower":       strings.ToLower,
+	"upper":       strings.ToUpper,
+}
+
+// fileData is what URL and header templates know about a file
+type fileData struct {
+	Name    string            // file name
+	Base    string            // file name without the extension
+	Ext     string            // extension, including the dot
+	Size    int64             // size in bytes
+	ModTime time.Time         // modification time
+	Path    string            // path relative to the folder, with forward slashes
+	Folder  string            // folder the file was found in
+	Match   []string          // submatches of namepattern, starting with the whole match
+	Groups  map[string]string // named submatches of namepattern
+}
+
+// parseTemplate parses the text as a template if it contains any actions
+func parseTemplate(name, text string) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		return nil, nil
+	}
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// ParseTemplates compiles the name pattern and parses the URL templates
+func (c *FolderCfg) ParseTemplates() error {
+	c.nameRe = nil
+	if c.NamePattern != "" {
+		re, err := regexp.Compile(c.NamePattern)
+		if err != nil {
+			return fmt.Errorf("namepattern: %w", err)
+		}
+		c.nameRe = re
+	}
+	c.urlTemplates = nil
+	for _, u := range c.Targets() {
+		t, err := parseTemplate("url", u)
+		if err != nil {
+			return err
+		}
+		c.urlTemplates = append(c.urlTemplates, t)
+	}
+	return nil
+}
+
+// newFileData gathers the template data of a file
+func newFileData(cfg *FolderCfg, inf os.FileInfo) *fileData {
+	ext := filepath.Ext(inf.Name())
+	d := &fileData{
+		Name:    inf.Name(),
+		Base:    strings.TrimSuffix(inf.Name(), ext),
+		Ext:     ext,
+		Size:    inf.Size(),
+		ModTime: inf.ModTime(),
+		Path:    filepath.ToSlash(inf.Name()),
+		Folder:  cfg.Folder,
+		Groups:  make(map[string]string),
+	}
+	if cfg.nameRe != nil {
+		d.Match = cfg.nameRe.FindStringSubmatch(inf.Name())
+		for i, group := range cfg.nameRe.SubexpNames() {
+			if group != "" && i < len(d.Match) {
+				d.Groups[group] = d.Match[i]
+			}
+		}
+	}
+	return d
+}
+
+// expand executes a template, or returns the text if it has none
+func expand(t *template.Template, text string, data *fileData) (string, error) {
+	if t == nil {
+		return text, nil
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// expandTargets returns the folder's URLs for a file
+func expandTargets(cfg *FolderCfg, data *fileData) ([]string, error) {
+	targets := cfg.Targets()
+	urls := make([]string, len(targets))
+	for i, target := range targets {
+		var t *template.Template
+		if i < len(cfg.urlTemplates) {
+			t = cfg.urlTemplates[i]
+		}
+		var err error
+		urls[i], err = expand(t, target, data)
+		if err != nil {
+			return nil, fmt.Errorf("url %s: %w", target, err)
+		}
+	}
+	return urls, nil
+}
+
+// expandHeaders returns headers or form fields for a file
+func expandHeaders(what string, hdrs []hdr, data *fileData) ([]hdr, error) {
+	headers := make([]hdr, len(hdrs))
+	for i, h := range hdrs {
+		headers[i] = h
+		var err error
+		headers[i].Value, err = expand(h.Template, h.Value, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", what, h.Key, err)
+		}
+	}
+	return headers, nil
+}
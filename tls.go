@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsVersions are the values of tlsmin
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// LoadTLS builds the TLS configuration of a folder, or none if the defaults will do
+func (c *FolderCfg) LoadTLS() error {
+	c.tlsConfig = nil
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" && c.TLSMin == "" && c.ServerName == "" && !c.Insecure {
+		return nil
+	}
+	tc := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.Insecure}
+	if c.TLSMin != "" {
+		v, ok := tlsVersions[c.TLSMin]
+		if !ok {
+			return fmt.Errorf("unknown tlsmin %q", c.TLSMin)
+		}
+		tc.MinVersion = v
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in cafile %s", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("certfile and keyfile must be set together")
+	}
+	if c.CertFile != "" {
+		kp := &keyPair{certFile: c.CertFile, keyFile: c.KeyFile}
+		if err := kp.load(); err != nil {
+			return err
+		}
+		tc.GetClientCertificate = kp.GetClientCertificate
+	}
+	c.tlsConfig = tc
+	return nil
+}
+
+// keyPair is a client certificate that is reloaded when its files change
+type keyPair struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time // modification time of the loaded certificate file
+	keyMod  time.Time // modification time of the loaded key file
+}
+
+// load reads the certificate and key if they changed since they were last loaded
+func (k *keyPair) load() error {
+	certMod, err := modTime(k.certFile)
+	if err != nil {
+		return err
+	}
+	keyMod, err := modTime(k.keyFile)
+	if err != nil {
+		return err
+	}
+	if k.cert != nil && certMod.Equal(k.certMod) && keyMod.Equal(k.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return err
+	}
+	k.cert, k.certMod, k.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// GetClientCertificate returns the client certificate for a handshake,
+// reloading it first if its files changed. If they cannot be loaded, the
+// previous certificate is used.
+func (k *keyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(); err != nil {
+		log.Print("Unable to reload client certificate ", k.certFile, ": ", err)
+	}
+	return k.cert, nil
+}
+
+// modTime returns the modification time of a file
+func modTime(fn string) (time.Time, error) {
+	inf, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return inf.ModTime(), nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ancientlore/kubismus"
+	"github.com/google/uuid"
+)
+
+// upload modes
+const (
+	UploadRange = "range" // chunks are sent to the URL with Content-Range headers
+	UploadTus   = "tus"   // chunks are sent with the tus resumable upload protocol
+)
+
+// tusVersion is the version of the tus protocol spoken
+const tusVersion = "1.0.0"
+
+// uploadFile is the name of the file in the state folder that holds upload offsets
+const uploadFile = "uploads.json"
+
+// uploadEntry is the progress of a chunked upload of a file to one URL
+type uploadEntry struct {
+	ID       string    `json:"id,omitempty"`       // upload ID sent with each chunk in range mode
+	Location string    `json:"location,omitempty"` // upload URL in tus mode
+	Offset   int64     `json:"offset"`             // bytes acknowledged by the server
+	Size     int64     `json:"size"`               // size of the file when the upload started
+	ModTime  time.Time `json:"modTime"`            // modification time of the file when the upload started
+}
+
+// uploadState tracks chunked uploads in progress so that they resume after
+// a failure or restart. It is saved to disk after every chunk.
+type uploadState struct {
+	mu    sync.Mutex
+	name  string
+	fn    string
+	files map[string]map[string]*uploadEntry // by file name and URL
+}
+
+// newUploadState creates the upload state for a folder, loading any saved
+// state of files that are still there
+func newUploadState(name string, cfg *FolderCfg) *uploadState {
+	u := &uploadState{
+		name:  name,
+		fn:    filepath.Join(stateDir(name, cfg), uploadFile),
+		files: make(map[string]map[string]*uploadEntry),
+	}
+	data, err := ioutil.ReadFile(u.fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(name, ": Unable to read upload state: ", err)
+		}
+		return u
+	}
+	if err := json.Unmarshal(data, &u.files); err != nil {
+		log.Print(name, ": Unable to parse upload state ", u.fn, ": ", err)
+		u.files = make(map[string]map[string]*uploadEntry)
+		return u
+	}
+	for fn := range u.files {
+		if !exists(filepath.Join(cfg.Folder, fn)) && !exists(filepath.Join(cfg.Folder, fn+claimSuffix)) {
+			delete(u.files, fn)
+		}
+	}
+	return u
+}
+
+// exists returns whether a file exists
+func exists(fn string) bool {
+	_, err := os.Lstat(fn)
+	return err == nil
+}
+
+// Get returns the upload of a file to a URL, or a new upload if there is none
+// or the file changed since it started. A nil upload state, as used by replay,
+// always starts over.
+func (u *uploadState) Get(fn, url string, inf os.FileInfo) uploadEntry {
+	fresh := uploadEntry{Size: inf.Size(), ModTime: inf.ModTime()}
+	if u == nil {
+		return fresh
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	e, ok := u.files[fn][url]
+	if !ok || e.Size != inf.Size() || !e.ModTime.Equal(inf.ModTime()) {
+		return fresh
+	}
+	return *e
+}
+
+// Set records the progress of an upload
+func (u *uploadState) Set(fn, url string, e uploadEntry) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	urls, ok := u.files[fn]
+	if !ok {
+		urls = make(map[string]*uploadEntry)
+		u.files[fn] = urls
+	}
+	urls[url] = &e
+	u.save()
+}
+
+// Completed forgets the upload of a file to a URL
+func (u *uploadState) Completed(fn, url string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.files[fn][url]; ok {
+		delete(u.files[fn], url)
+		if len(u.files[fn]) == 0 {
+			delete(u.files, fn)
+		}
+		u.save()
+	}
+}
+
+// Done forgets the uploads of a file that was posted or given up on
+func (u *uploadState) Done(fn string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.files[fn]; ok {
+		delete(u.files, fn)
+		u.save()
+	}
+}
+
+// save writes the upload state to disk; the lock must be held
+func (u *uploadState) save() {
+	data, err := json.MarshalIndent(u.files, "", "\t")
+	if err != nil {
+		log.Print(u.name, ": Unable to encode upload state: ", err)
+		return
+	}
+	err = writeFileAtomic(u.fn, data)
+	if err != nil {
+		log.Print(u.name, ": Unable to save upload state: ", err)
+	}
+}
+
+// chunked returns whether a file is uploaded in chunks
+func chunked(cfg *FolderCfg, inf os.FileInfo) bool {
+	return cfg.Upload != "" && cfg.ChunkSize > 0 && inf.Size() > cfg.ChunkSize
+}
+
+// uploadTarget uploads a file to one URL in chunks, resuming where an earlier
+// attempt left off. Only the acknowledged offset is saved, so a chunk that
+// failed is sent again.
+func uploadTarget(ctx context.Context, name string, cfg *FolderCfg, url string, spec *requestSpec, fname string, inf os.FileInfo, rec *auditRecord) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		log.Printf("%s: Unable to open %s", name, fname)
+		return err
+	}
+	defer f.Close()
+
+	rec.URL = url
+	rec.Method = spec.method
+	t := time.Now()
+	defer func() {
+		rec.Latency = time.Since(t).Seconds()
+	}()
+
+	e := cfg.uploads.Get(inf.Name(), url, inf)
+	if cfg.Upload == UploadTus {
+		rec.Method = http.MethodPatch
+		if err = tusStart(ctx, name, cfg, url, spec, inf, &e, rec); err != nil {
+			return err
+		}
+	} else if e.ID == "" {
+		guid, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		e.ID = guid.String()
+	}
+	if e.Offset > 0 {
+		log.Print(name, ": resuming upload of ", inf.Name(), " to ", url, " at ", e.Offset, " of ", inf.Size(), " bytes")
+	}
+
+	for e.Offset < inf.Size() {
+		n := cfg.ChunkSize
+		if rem := inf.Size() - e.Offset; rem < n {
+			n = rem
+		}
+		if cfg.Upload == UploadTus {
+			err = tusChunk(ctx, name, cfg, spec, f, inf, &e, n, rec)
+		} else {
+			err = rangeChunk(ctx, name, cfg, url, spec, f, inf, &e, n, rec)
+		}
+		if err != nil {
+			return err
+		}
+		if e.Offset < inf.Size() {
+			cfg.uploads.Set(inf.Name(), url, e)
+		}
+	}
+	cfg.uploads.Completed(inf.Name(), url)
+	return nil
+}
+
+// rangeChunk sends one chunk of a file with a Content-Range header. Servers
+// that acknowledge a chunk with 308 may say how much they have in a Range
+// header, which is where the next chunk starts.
+func rangeChunk(ctx context.Context, name string, cfg *FolderCfg, url string, spec *requestSpec, f *os.File, inf os.FileInfo, e *uploadEntry, n int64, rec *auditRecord) error {
+	req, err := http.NewRequestWithContext(ctx, spec.method, url, io.NewSectionReader(f, e.Offset, n))
+	if err != nil {
+		return postError{err: err, action: OutcomeFail, url: url}
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", e.Offset, e.Offset+n-1, inf.Size()))
+	req.Header.Set("X-Autohurl-Upload", e.ID)
+	ct := spec.contentType
+	if ct == "" {
+		ct = mime.TypeByExtension(filepath.Ext(inf.Name()))
+	}
+	if ct != "" {
+		req.Header.Set("Content-Type", ct)
+	}
+	setFileInfo(req, cfg, inf)
+	if err = setHeaders(req, cfg, spec, rec); err != nil {
+		return err
+	}
+
+	resp, t, err := sendChunk(ctx, name, cfg, url, req, n)
+	if err != nil {
+		return err
+	}
+	last := e.Offset+n == inf.Size()
+	if resp.StatusCode == http.StatusPermanentRedirect && !last {
+		discardResponse(cfg, resp, t, rec)
+		e.Offset += n
+		if r := resp.Header.Get("Range"); strings.HasPrefix(r, "bytes=0-") {
+			if end, err := strconv.ParseInt(strings.TrimPrefix(r, "bytes=0-"), 10, 64); err == nil && end < inf.Size() {
+				e.Offset = end + 1
+			}
+		}
+		return nil
+	}
+	if err = checkResponse(name, cfg, url, resp, t, rec); err != nil {
+		return err
+	}
+	e.Offset += n
+	return nil
+}
+
+// tusStart creates the tus upload of a file, or asks the server how much of
+// an earlier upload it has. An upload the server no longer knows starts over.
+func tusStart(ctx context.Context, name string, cfg *FolderCfg, url string, spec *requestSpec, inf os.FileInfo, e *uploadEntry, rec *auditRecord) error {
+	if e.Location != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, e.Location, nil)
+		if err != nil {
+			return postError{err: err, action: OutcomeFail, url: url}
+		}
+		req.Header.Set("Tus-Resumable", tusVersion)
+		if err = setHeaders(req, cfg, spec, rec); err != nil {
+			return err
+		}
+		resp, t, err := sendChunk(ctx, name, cfg, url, req, 0)
+		if err != nil {
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound, http.StatusGone, http.StatusForbidden:
+			discardResponse(cfg, resp, t, rec)
+			log.Print(name, ": upload of ", inf.Name(), " to ", url, " is gone, starting over")
+			*e = uploadEntry{Size: inf.Size(), ModTime: inf.ModTime()}
+		default:
+			if err = checkResponse(name, cfg, url, resp, t, rec); err != nil {
+				return err
+			}
+			off, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+			if err != nil || off < 0 || off > inf.Size() {
+				return postError{err: fmt.Errorf("bad Upload-Offset from %s", e.Location), action: OutcomeRetry, status: resp.StatusCode, url: url}
+			}
+			e.Offset = off
+			return nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return postError{err: err, action: OutcomeFail, url: url}
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(inf.Size(), 10))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(inf.Name())))
+	setFileInfo(req, cfg, inf)
+	if err = setHeaders(req, cfg, spec, rec); err != nil {
+		return err
+	}
+	resp, t, err := sendChunk(ctx, name, cfg, url, req, 0)
+	if err != nil {
+		return err
+	}
+	if err = checkResponse(name, cfg, url, resp, t, rec); err != nil {
+		return err
+	}
+	loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return postError{err: errors.New(fmt.Sprint(name, ": No upload location from ", url)), action: OutcomeRetry, status: resp.StatusCode, url: url}
+	}
+	e.Location = loc.String()
+	e.Offset = 0
+	cfg.uploads.Set(inf.Name(), url, *e)
+	return nil
+}
+
+// tusChunk sends one chunk of a file to its tus upload
+func tusChunk(ctx context.Context, name string, cfg *FolderCfg, spec *requestSpec, f *os.File, inf os.FileInfo, e *uploadEntry, n int64, rec *auditRecord) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, e.Location, io.NewSectionReader(f, e.Offset, n))
+	if err != nil {
+		return postError{err: err, action: OutcomeFail, url: e.Location}
+	}
+	req.ContentLength = n
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(e.Offset, 10))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	if err = setHeaders(req, cfg, spec, rec); err != nil {
+		return err
+	}
+
+	resp, t, err := sendChunk(ctx, name, cfg, e.Location, req, n)
+	if err != nil {
+		return err
+	}
+	if err = checkResponse(name, cfg, e.Location, resp, t, rec); err != nil {
+		return err
+	}
+	e.Offset += n
+	if off, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64); err == nil && off >= 0 && off <= inf.Size() {
+		e.Offset = off
+	}
+	return nil
+}
+
+// sendChunk sends one request of a chunked upload, counting the n bytes sent
+func sendChunk(ctx context.Context, name string, cfg *FolderCfg, url string, req *http.Request, n int64) (*http.Response, time.Time, error) {
+	t := time.Now()
+	resp, err := cfg.client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return nil, t, ctx.Err()
+	}
+	if err != nil {
+		kubismus.Metric(name+"_Errors", 1, 0)
+		log.Print(name, ": HTTP error ", url, ": ", err)
+		return nil, t, postError{err: err, action: errorOutcome(cfg.Outcomes, err), url: url}
+	}
+	if n > 0 {
+		kubismus.Metric(name+"_Sent", 1, float64(n))
+		cfg.stats.Sent.Add(n)
+	}
+	return resp, t, nil
+}
+
+// discardResponse reads and closes a response that needs no checking
+func discardResponse(cfg *FolderCfg, resp *http.Response, t time.Time, rec *auditRecord) {
+	sz, _ := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	cfg.stats.Received.Add(sz)
+	cfg.stats.Response(resp.StatusCode, time.Since(t))
+	rec.Status = resp.StatusCode
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyWatcher reports files that are closed after writing or moved into a folder
+type inotifyWatcher struct {
+	f      *os.File
+	events chan string
+	done   chan struct{}
+}
+
+// newWatcher creates an inotify watcher on the given folder
+func newWatcher(folder string) (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	_, err = syscall.InotifyAddWatch(fd, folder, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	w := &inotifyWatcher{
+		// a non-blocking descriptor lets the runtime poller unblock Read on Close
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan string, 64),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Events returns the channel of file names that are ready
+func (w *inotifyWatcher) Events() <-chan string {
+	return w.events
+}
+
+// Close stops the watcher and closes the events channel
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.f.Close()
+}
+
+// run reads inotify events until the descriptor is closed
+func (w *inotifyWatcher) run() {
+	defer close(w.events)
+	var buf [syscall.SizeofInotifyEvent * 256]byte
+	// cookie of the last rename away from a claimed name; the kernel reports
+	// both halves of a rename together
+	var claimedCookie uint32
+	for {
+		n, err := w.f.Read(buf[:])
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Print("inotify: read error: ", err)
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(ev.Len)
+			offset = nameEnd
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// events were lost - the periodic rescan will pick the files up
+				log.Print("inotify: event queue overflow")
+				continue
+			}
+			if ev.Mask&syscall.IN_ISDIR != 0 || ev.Len == 0 || nameEnd > n {
+				continue
+			}
+			name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+			if ev.Mask&syscall.IN_MOVED_FROM != 0 {
+				if isClaimed(name) {
+					claimedCookie = ev.Cookie
+				}
+				continue
+			}
+			if ev.Mask&syscall.IN_MOVED_TO != 0 && ev.Cookie != 0 && ev.Cookie == claimedCookie {
+				// a poster put back a file it could not finish; leave it for the rescan
+				claimedCookie = 0
+				continue
+			}
+			select {
+			case w.events <- name:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newWatcher is not available on this platform
+func newWatcher(folder string) (watcher, error) {
+	return nil, errors.New("inotify is only supported on Linux")
+}